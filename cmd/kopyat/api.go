@@ -22,6 +22,12 @@ import (
 
 const apiSocketFileName = "api.socket"
 
+// apiRequestHeader must be set on every request that changes the state of the
+// service. Browsers don't let a page set custom headers on cross-origin
+// requests without a CORS preflight, which the API doesn't answer, so requiring
+// it keeps other sites from triggering actions through the dashboard's session.
+const apiRequestHeader = "X-Kopyat-Request"
+
 type httpClient struct {
 	*http.Client
 	u          *url.URL
@@ -141,6 +147,7 @@ func (hc *httpClient) NewRequest(method, path string, body io.ReadCloser) (*http
 	if hc.basicAuth != nil {
 		req.Header.Set("Authorization", "Basic "+hc.basicAuth())
 	}
+	req.Header.Set(apiRequestHeader, "1")
 	return req, nil
 }
 
@@ -148,6 +155,7 @@ func (hc *httpClient) Do(req *http.Request) (*http.Response, error) {
 	if hc.basicAuth != nil {
 		req.Header.Set("Authorization", "Basic "+hc.basicAuth())
 	}
+	req.Header.Set(apiRequestHeader, "1")
 	resp, err := hc.Client.Do(req)
 	if err != nil {
 		return nil, err
@@ -199,6 +207,7 @@ func (hc *httpClient) Post(path string, contentType string, body io.Reader) (*ht
 	if hc.basicAuth != nil {
 		req.Header.Set("Authorization", "Basic "+hc.basicAuth())
 	}
+	req.Header.Set(apiRequestHeader, "1")
 	req.Header.Set("Content-Type", contentType)
 	resp, err := hc.Client.Do(req)
 	if err != nil {
@@ -214,12 +223,40 @@ func (hc *httpClient) PostForm(path string, data url.Values) (*http.Response, er
 }
 
 func (s *svc) setupRouter(e *echo.Echo) {
+	e.Use(requireRequestHeader)
 	e.GET("/ping", func(c echo.Context) error {
 		return c.String(http.StatusOK, "Pong")
 	})
 	e.GET("/watch-job", s.getWatchJobs)
-	e.GET("/watch-job/stop", s.stopWatchJobs)
+	e.POST("/watch-job", s.addWatchJob)
+	e.POST("/watch-job/stop", s.stopWatchJobs)
+	e.POST("/watch-job/start", s.startWatchJobs)
+	e.POST("/watch-job/restart", s.restartWatchJobs)
+	e.POST("/watch-job/remove", s.removeWatchJobs)
+	e.GET("/backup", s.getBackups)
+	e.GET("/backup/history", s.getBackupHistory)
+	e.POST("/backup/run", s.runBackups)
 	e.GET("/service/reload", s.reload)
+	e.GET("/", func(c echo.Context) error {
+		return c.Redirect(http.StatusFound, "/dashboard/")
+	})
+	e.GET("/dashboard", func(c echo.Context) error {
+		return c.Redirect(http.StatusFound, "/dashboard/")
+	})
+	e.GET("/dashboard/*", s.dashboard)
+}
+
+// requireRequestHeader rejects requests other than GET and HEAD
+// that don't carry apiRequestHeader.
+func requireRequestHeader(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		method := c.Request().Method
+		if method != http.MethodGet && method != http.MethodHead &&
+			c.Request().Header.Get(apiRequestHeader) == "" {
+			return c.String(http.StatusForbidden, "missing "+apiRequestHeader+" header")
+		}
+		return next(c)
+	}
 }
 
 func (s *svc) newAPIServer() (
@@ -3,12 +3,18 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/karagenc/kopyat/internal/backup"
+	_config "github.com/karagenc/kopyat/internal/config"
 	_ctx "github.com/karagenc/kopyat/internal/scripting/ctx"
 	"github.com/karagenc/kopyat/internal/utils"
+	"github.com/labstack/echo/v4"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
@@ -69,6 +75,8 @@ var backupCmd = &cobra.Command{
 			exit(exitErrAny)
 		}
 
+		// Backups that skipped unreadable directories, for the summary.
+		var skippedUnreadable []string
 		for _, backup := range backups {
 			if !noRemind {
 				remindAll(backup.Config.Reminders.Pre)
@@ -103,6 +111,9 @@ var backupCmd = &cobra.Command{
 				errPrintln(err)
 				exit(exitErrAny)
 			}
+			if n := len(backup.Paths.Unreadable()); n > 0 && backup.Config.OnUnreadable != _config.OnUnreadableSkip {
+				skippedUnreadable = append(skippedUnreadable, fmt.Sprintf("%s: %d unreadable directories were skipped", backup.Name, n))
+			}
 
 			if !noHook {
 				err = runHooks(
@@ -127,5 +138,210 @@ var backupCmd = &cobra.Command{
 		}
 
 		utils.Success.Println("\nBackup successful")
+		for _, s := range skippedUnreadable {
+			utils.Warn.Println(s)
+		}
 	},
 }
+
+const (
+	backupHistoryFileName = "backup_history.json"
+	maxBackupHistory      = 100
+)
+
+type (
+	backupRecord struct {
+		Name     string    `json:"name"`
+		Started  time.Time `json:"started"`
+		Finished time.Time `json:"finished"`
+		Skipped  bool      `json:"skipped"`
+		Error    string    `json:"error"`
+		// Directories that couldn't be read while generating the ifile, and were skipped.
+		Unreadable []string `json:"unreadable,omitempty"`
+	}
+
+	backupInfo struct {
+		Name    string        `json:"name"`
+		Running bool          `json:"running"`
+		Last    *backupRecord `json:"last"`
+	}
+)
+
+func (s *svc) loadBackupHistory() error {
+	content, err := os.ReadFile(filepath.Join(stateDir, backupHistoryFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.backupsMu.Lock()
+	defer s.backupsMu.Unlock()
+	return json.Unmarshal(content, &s.backupHistory)
+}
+
+// Should be called with s.backupsMu locked.
+func (s *svc) saveBackupHistory() error {
+	content, err := json.Marshal(s.backupHistory)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stateDir, backupHistoryFileName), content, 0644)
+}
+
+// runBackup runs the backup with the given name the way `kopyat backup` does,
+// except that reminders are not prompted, as there is no one to respond to them.
+// The caller must mark the backup as running in s.backupsRunning.
+func (s *svc) runBackup(name string) (err error) {
+	record := &backupRecord{Name: name, Started: time.Now()}
+	s.backupsMu.Lock()
+	s.backupHistory = append(s.backupHistory, record)
+	if len(s.backupHistory) > maxBackupHistory {
+		s.backupHistory = s.backupHistory[len(s.backupHistory)-maxBackupHistory:]
+	}
+	s.backupsMu.Unlock()
+
+	var (
+		skip       = false
+		unreadable []string
+	)
+	defer func() {
+		s.backupsMu.Lock()
+		defer s.backupsMu.Unlock()
+		delete(s.backupsRunning, name)
+		record.Finished = time.Now()
+		record.Skipped = skip
+		record.Unreadable = unreadable
+		if err != nil {
+			record.Error = err.Error()
+		}
+		saveErr := s.saveBackupHistory()
+		if saveErr != nil {
+			s.log.Error(saveErr.Error())
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	backups, err := backup.FromConfig(ctx, &config.Backups, cacheDir, s.log, true, name)
+	if err != nil {
+		return err
+	}
+	b, ok := backups[name]
+	if !ok {
+		skip = true
+		return nil
+	}
+
+	s.log.Sugar().Infof("Backup: %s", name)
+	err = newHookRunner(b.Config.Hooks.Pre, _ctx.NewBackupContext(
+		true,
+		b.Name,
+		b.Provider.TargetPath(),
+		b.Config.Base,
+		b.Config.Paths,
+		func() { skip = true },
+		b.UseIfile,
+	))()
+	if err != nil {
+		return fmt.Errorf("failed to run pre hook: %v", err)
+	}
+	if skip {
+		s.log.Sugar().Infof("Skipping backup: %s", name)
+		return nil
+	}
+
+	err = b.Do()
+	if err != nil {
+		return err
+	}
+	for _, u := range b.Paths.Unreadable() {
+		unreadable = append(unreadable, u.Path)
+	}
+
+	err = newHookRunner(b.Config.Hooks.Post, _ctx.NewBackupContext(
+		false,
+		b.Name,
+		b.Provider.TargetPath(),
+		b.Config.Base,
+		b.Config.Paths,
+		func() {}, // Noop for post hooks
+		b.UseIfile,
+	))()
+	if err != nil {
+		return fmt.Errorf("failed to run post hook: %v", err)
+	}
+	return nil
+}
+
+func (s *svc) getBackups(c echo.Context) error {
+	s.backupsMu.Lock()
+	defer s.backupsMu.Unlock()
+
+	infos := make([]*backupInfo, 0, len(config.Backups.Run))
+	for _, run := range config.Backups.Run {
+		info := &backupInfo{
+			Name:    run.Name,
+			Running: s.backupsRunning[run.Name],
+		}
+		for i := len(s.backupHistory) - 1; i >= 0; i-- {
+			if s.backupHistory[i].Name == run.Name {
+				record := *s.backupHistory[i]
+				info.Last = &record
+				break
+			}
+		}
+		infos = append(infos, info)
+	}
+	return c.JSON(http.StatusOK, infos)
+}
+
+// Newest first.
+func (s *svc) getBackupHistory(c echo.Context) error {
+	s.backupsMu.Lock()
+	records := make([]backupRecord, 0, len(s.backupHistory))
+	for i := len(s.backupHistory) - 1; i >= 0; i-- {
+		records = append(records, *s.backupHistory[i])
+	}
+	s.backupsMu.Unlock()
+	return c.JSON(http.StatusOK, records)
+}
+
+func (s *svc) runBackups(c echo.Context) error {
+	var names []string
+	err := c.Bind(&names)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]string, 0)
+	for _, name := range names {
+		found := false
+		for _, run := range config.Backups.Run {
+			if run.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("no backup with name: %s", name))
+			continue
+		}
+
+		s.backupsMu.Lock()
+		running := s.backupsRunning[name]
+		s.backupsRunning[name] = true
+		s.backupsMu.Unlock()
+		if running {
+			errs = append(errs, fmt.Sprintf("backup is already running: %s", name))
+			continue
+		}
+
+		go func(name string) {
+			err := s.runBackup(name)
+			if err != nil {
+				s.log.Error(fmt.Sprintf("backup %s: %v", name, err))
+			}
+		}(name)
+	}
+	return c.JSON(http.StatusOK, errs)
+}
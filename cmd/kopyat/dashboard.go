@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rakyll/statik/fs"
+
+	_ "github.com/karagenc/kopyat/internal/dashboard"
+)
+
+const dashboardNamespace = "dashboard"
+
+var dashboardFS = sync.OnceValues(func() (http.FileSystem, error) {
+	return fs.NewWithNamespace(dashboardNamespace)
+})
+
+func (s *svc) dashboard(c echo.Context) error {
+	statikFS, err := dashboardFS()
+	if err != nil {
+		return c.String(http.StatusNotFound, fmt.Sprintf("dashboard is not embedded within executable (%v). build kopyat with `make` to include it", err))
+	}
+	h := http.StripPrefix("/dashboard", http.FileServer(statikFS))
+	h.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 
 	"github.com/fatih/color"
+	"github.com/karagenc/kopyat/internal/ifile"
 	"github.com/karagenc/kopyat/internal/utils"
 	"github.com/spf13/cobra"
 )
@@ -78,6 +81,7 @@ var doctorCmd = &cobra.Command{
 				errorFound = true
 			} else {
 				fmt.Printf(`        API is %s: "Pong" received`+"\n", utils.HiGreen.Sprint("up"))
+				checkWatchJobs(hc)
 			}
 		}
 
@@ -89,3 +93,32 @@ var doctorCmd = &cobra.Command{
 		}
 	},
 }
+
+// Report the watch jobs that have switched to polling.
+func checkWatchJobs(hc *httpClient) {
+	resp, err := hc.Get("/watch-job")
+	if err != nil {
+		utils.Error.Printf("        Error getting watch jobs: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		utils.Error.Printf("        Error getting watch jobs: %v\n", err)
+		return
+	}
+	var infos []*ifile.WatchJobInfo
+	err = json.Unmarshal(content, &infos)
+	if err != nil {
+		utils.Error.Printf("        Error getting watch jobs: %v\n", err)
+		return
+	}
+	for _, info := range infos {
+		if info.PollingFallback != "" {
+			utils.Warn.Printf("        Watch job for %s has fallen back to polling: %s\n", info.Ifile, info.PollingFallback)
+		}
+		for _, path := range info.Unreadable {
+			utils.Warn.Printf("        Watch job for %s can't read %s, and skips it\n", info.Ifile, path)
+		}
+	}
+}
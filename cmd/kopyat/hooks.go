@@ -31,3 +31,16 @@ func runHook(errGroup *errgroup.Group, command string, c ctx.Context) error {
 		return run()
 	}
 }
+
+func newHookRunner(hooks []string, c ctx.Context) func() error {
+	return func() error {
+		errGroup := &errgroup.Group{}
+		for _, hook := range hooks {
+			err := runHook(errGroup, hook, c)
+			if err != nil {
+				return err
+			}
+		}
+		return errGroup.Wait()
+	}
+}
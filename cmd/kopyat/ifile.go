@@ -1,14 +1,39 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/karagenc/kopyat/internal/backup"
+	_config "github.com/karagenc/kopyat/internal/config"
 	"github.com/karagenc/kopyat/internal/ifile"
+	"github.com/karagenc/kopyat/internal/utils"
+	"github.com/pmezard/go-difflib/difflib"
 	"github.com/spf13/cobra"
 )
 
+func init() {
+	f := ifileExplainCmd.Flags()
+	f.StringP("backup", "b", "", "Name of the backup to explain the path for")
+	f.StringP("ifile", "i", "", "Ifile of the ifile generation run to explain the path for")
+	f.StringP("root", "r", "", "Directory to walk, with the default options")
+
+	ifileGenerateSyncthingCmd.Flags().BoolP("patterns", "p", false, "Translate the patterns of the ignore files instead of listing the excluded paths")
+	ifileGenerateResticCmd.Flags().StringP("output", "o", "", "File to write the ifile to. Default is stdout")
+	ifileGenerateRsyncCmd.Flags().StringP("output", "o", "", "File to write the filter rules to. Default is <dir>/.rsync-filter")
+	ifileGenerateTarCmd.Flags().StringP("output", "o", "", "File to write the exclude list to. Default is <dir>/.tar-exclude")
+
+	f = ifilePreviewCmd.Flags()
+	f.StringP("backup", "b", "", "Name of the backup to preview the ifile of")
+	f.StringP("ifile", "i", "", "Ifile of the ifile generation run to preview")
+	f.StringP("syncthing", "s", "", "Syncthing directory to preview the .stignore of, with the default options")
+	f.StringP("output", "o", "", "Also write the generated ifile to this file")
+}
+
 var (
 	ifileCmd         = &cobra.Command{Use: "ifile"}
 	ifileGenerateCmd = &cobra.Command{Use: "generate"}
@@ -18,34 +43,451 @@ var (
 		Long: "Manually generate syncthing ifile at the specified directory",
 		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			dir := args[0]
-			stignore := filepath.Join(dir, ".stignore")
+			mode := ifile.ModeSyncthing
+			if patterns, _ := cmd.Flags().GetBool("patterns"); patterns {
+				mode = ifile.ModeSyncthingPatterns
+			}
+			generateInDir(args[0], filepath.Join(args[0], ".stignore"), mode)
+		},
+	}
+
+	ifileGenerateRsyncCmd = &cobra.Command{
+		Use:  "rsync <dir>",
+		Long: "Manually generate rsync filter file of the specified directory. Use it with: rsync --filter='merge <ifile>' <dir>/ <dest>",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			output, _ := cmd.Flags().GetString("output")
+			if output == "" {
+				output = filepath.Join(args[0], ".rsync-filter")
+			}
+			generateInDir(args[0], output, ifile.ModeRsync)
+		},
+	}
+
+	ifileGenerateTarCmd = &cobra.Command{
+		Use:  "tar <dir>",
+		Long: "Manually generate tar exclude file of the specified directory. Use it with: tar -C <dir> --anchored --exclude-from=<ifile> -cf <archive> .",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			output, _ := cmd.Flags().GetString("output")
+			if output == "" {
+				output = filepath.Join(args[0], ".tar-exclude")
+			}
+			generateInDir(args[0], output, ifile.ModeTar)
+		},
+	}
+
+	ifileGenerateResticCmd = &cobra.Command{
+		Use:  "restic <backup>",
+		Long: "Generate the ifile (include list, or exclude file if `ifile_mode` is exclude) of a backup without running the backup",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			name := args[0]
+			output, _ := cmd.Flags().GetString("output")
+
+			backups, err := backup.FromConfig(context.Background(), &config.Backups, cacheDir, debugLog, false, name)
+			if err != nil {
+				errPrintln(err)
+				exit(exitErrAny)
+			}
+			b, ok := backups[name]
+			if !ok {
+				errPrintln(fmt.Errorf("backup %s is skipped", name))
+				exit(exitErrAny)
+			}
+			if !b.UseIfile {
+				utils.Warn.Fprintf(os.Stderr, "Backup %s doesn't use ifile. The list is not used by it.\n", b.Name)
+			}
 
-			stat, err := os.Stat(dir)
+			if output != "" {
+				fmt.Fprintf(os.Stderr, "Walking paths of %s\n", b.Name)
+				err = b.Paths.GenerateIfile(output)
+				if err != nil {
+					errPrintln(err)
+					exit(exitErrAny)
+				}
+				return
+			}
+
+			// Ifile is written to a file, which is then copied to stdout.
+			tmp, err := os.CreateTemp("", "kopyat-"+b.Name+"-*.list")
 			if err != nil {
 				errPrintln(err)
 				exit(exitErrAny)
 			}
-			if !stat.IsDir() {
-				errPrintln(fmt.Errorf("not a directory: %s", dir))
+			tmp.Close()
+			defer os.Remove(tmp.Name())
+			addExitHandler(func() { os.Remove(tmp.Name()) })
+			err = b.Paths.GenerateIfile(tmp.Name())
+			if err != nil {
+				errPrintln(err)
+				exit(exitErrAny)
+			}
+			f, err := os.Open(tmp.Name())
+			if err != nil {
+				errPrintln(err)
 				exit(exitErrAny)
 			}
+			defer f.Close()
+			_, err = io.Copy(os.Stdout, f)
+			if err != nil {
+				errPrintln(err)
+				exit(exitErrAny)
+			}
+		},
+	}
 
-			fmt.Printf("Creating/opening %s\n", stignore)
-			ifile, err := ifile.New(stignore, ifile.ModeSyncthing, true, debugLog)
+	ifileExplainCmd = &cobra.Command{
+		Use:   "explain <path>",
+		Short: "Show why a path is excluded from an ifile or not",
+		Long:  "Show whether a path is excluded from the ifile of a backup or an ifile generation run, and every pattern that matches it, the highest precedence first",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, err := filepath.Abs(args[0])
+			if err != nil {
+				errPrintln(err)
+				exit(exitErrAny)
+			}
+			root, opts, err := explainRoot(cmd, path)
 			if err != nil {
 				errPrintln(err)
 				exit(exitErrAny)
 			}
-			defer ifile.Close() // For panic
-			addExitHandler(func() { ifile.Close() })
 
-			fmt.Printf("Walking %s\n", dir)
-			err = ifile.Walk(dir)
+			e, err := ifile.Explain(root, path, opts)
 			if err != nil {
 				errPrintln(err)
 				exit(exitErrAny)
 			}
+
+			if e.Excluded {
+				fmt.Printf("%s: %s\n", e.Path, utils.Red.Sprint("excluded"))
+			} else {
+				fmt.Printf("%s: %s\n", e.Path, utils.HiGreen.Sprint("included"))
+			}
+			if e.ExcludedDir != "" {
+				fmt.Printf("It is inside the excluded directory %s. Patterns below match the directory.\n", e.ExcludedDir)
+			}
+			if e.Filter != "" {
+				fmt.Printf("It is excluded by the filters: %s.\n", e.Filter)
+			}
+			if e.Marker != "" {
+				fmt.Printf("It is excluded by the marker file %s.\n", e.Marker)
+			}
+			// Excluded regardless of the patterns.
+			excludedByOther := e.Filter != "" || e.Marker != ""
+			if len(e.Matches) == 0 {
+				if e.Excluded && !excludedByOther {
+					fmt.Println("No pattern matches it, but its parent directory is excluded.")
+				} else {
+					fmt.Println("No pattern matches it.")
+				}
+				return
+			}
+
+			fmt.Println("Matching patterns, the highest precedence first (* decided):")
+			decided := false
+			for _, m := range e.Matches {
+				mark := " "
+				if m.Decisive {
+					mark = "*"
+					decided = true
+				}
+				fmt.Printf("  %s %s:%d: %s\n", mark, m.File, m.Line, m.Pattern)
+			}
+			if !decided && e.Excluded && !excludedByOther {
+				fmt.Println("None of them decided (they are negated), but its parent directory is excluded.")
+			}
 		},
 	}
 )
+
+var ifilePreviewCmd = &cobra.Command{
+	Use:   "preview",
+	Short: "Show how a regeneration would change an ifile",
+	Long:  "Generate the ifile of a backup, an ifile generation run, or a syncthing directory without touching the current one, and show a unified diff against it, together with numbers of the included and excluded files",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		tmp, err := os.CreateTemp("", "kopyat-preview-*")
+		if err != nil {
+			errPrintln(err)
+			exit(exitErrAny)
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		addExitHandler(func() { os.Remove(tmp.Name()) })
+
+		current, totals, err := generatePreview(cmd, tmp.Name())
+		if err != nil {
+			errPrintln(err)
+			exit(exitErrAny)
+		}
+
+		currentContent, err := os.ReadFile(current)
+		if os.IsNotExist(err) {
+			utils.Warn.Printf("%s doesn't exist. Comparing against an empty file.\n", current)
+			if backupName, _ := cmd.Flags().GetString("backup"); backupName != "" {
+				fmt.Println("To keep the list of the last backup, set `keep_ifile` of the backup.")
+			}
+		} else if err != nil {
+			errPrintln(err)
+			exit(exitErrAny)
+		}
+		generatedContent, err := os.ReadFile(tmp.Name())
+		if err != nil {
+			errPrintln(err)
+			exit(exitErrAny)
+		}
+		if output != "" {
+			err = os.WriteFile(output, generatedContent, 0644)
+			if err != nil {
+				errPrintln(err)
+				exit(exitErrAny)
+			}
+		}
+
+		toFile := "generated"
+		if output != "" {
+			toFile = output
+		}
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        splitLines(currentContent),
+			B:        splitLines(generatedContent),
+			FromFile: current,
+			ToFile:   toFile,
+			Context:  3,
+		})
+		if err != nil {
+			errPrintln(err)
+			exit(exitErrAny)
+		}
+		if diff == "" {
+			fmt.Printf("No changes to %s\n", current)
+		} else {
+			fmt.Print(diff)
+		}
+
+		fmt.Println()
+		fmt.Printf("Files included: %d\n", totals.FilesIncluded)
+		fmt.Printf("Files excluded: %d\n", totals.FilesExcluded)
+		fmt.Printf("Bytes excluded: %s (%d bytes)\n", utils.FormatBytes(totals.BytesExcluded), totals.BytesExcluded)
+		printUnreadable(totals.Unreadable)
+	},
+}
+
+// Split content into lines for diffing. Lines keep their newlines.
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Generate the ifile given by the flags at filePath. Return the path of the current ifile.
+func generatePreview(cmd *cobra.Command, filePath string) (current string, totals ifile.Totals, err error) {
+	var (
+		f               = cmd.Flags()
+		backupName, _   = f.GetString("backup")
+		ifilePath, _    = f.GetString("ifile")
+		syncthingDir, _ = f.GetString("syncthing")
+		opts            *ifile.Options
+		dir             string
+		mode            = ifile.ModeSyncthing
+	)
+	switch {
+	case backupName != "" && ifilePath == "" && syncthingDir == "":
+		backups, err := backup.FromConfig(context.Background(), &config.Backups, cacheDir, debugLog, false, backupName)
+		if err != nil {
+			return "", totals, err
+		}
+		b, ok := backups[backupName]
+		if !ok {
+			return "", totals, fmt.Errorf("backup %s is skipped", backupName)
+		}
+		if !b.UseIfile {
+			utils.Warn.Printf("Backup %s doesn't use ifile. Ignore files have no effect on it.\n", b.Name)
+		}
+		totals, err = b.Paths.Preview(filePath)
+		return b.Paths.IfilePath(), totals, err
+	case ifilePath != "" && backupName == "" && syncthingDir == "":
+		run, err := findIfileGenerationRun(ifilePath)
+		if err != nil {
+			return "", totals, err
+		}
+		mode, err = ifileMode(run.Mode)
+		if err != nil {
+			return "", totals, err
+		}
+		current, dir, opts = run.Ifile, filepath.Dir(run.Ifile), ifileOptions(run)
+	case syncthingDir != "" && backupName == "" && ifilePath == "":
+		dir, err = filepath.Abs(syncthingDir)
+		if err != nil {
+			return "", totals, err
+		}
+		current = filepath.Join(dir, ".stignore")
+	default:
+		return "", totals, fmt.Errorf("specify exactly one of --backup, --ifile or --syncthing")
+	}
+
+	// The generated ifile keeps the lines of the current one that are not generated.
+	content, err := os.ReadFile(current)
+	if err != nil && !os.IsNotExist(err) {
+		return "", totals, err
+	}
+	err = os.WriteFile(filePath, content, 0600)
+	if err != nil {
+		return "", totals, err
+	}
+	i, err := ifile.NewWithOptions(filePath, mode, true, opts, debugLog)
+	if err != nil {
+		return "", totals, err
+	}
+	totals, err = i.WalkWithTotals(dir)
+	if err != nil {
+		i.Discard()
+		return "", totals, err
+	}
+	return current, totals, i.Close()
+}
+
+// Return the directory walked for path, and the options of the backup or the ifile
+// generation run given by the flags.
+func explainRoot(cmd *cobra.Command, path string) (root string, opts *ifile.Options, err error) {
+	var (
+		f             = cmd.Flags()
+		backupName, _ = f.GetString("backup")
+		ifilePath, _  = f.GetString("ifile")
+		rootFlag, _   = f.GetString("root")
+		backupRun     *_config.BackupRun
+	)
+	switch {
+	case backupName != "" && ifilePath == "" && rootFlag == "":
+		for _, run := range config.Backups.Run {
+			if run.Name == backupName {
+				backupRun = run
+			}
+		}
+		if backupRun == nil {
+			return "", nil, fmt.Errorf("backup `%s` not found in config", backupName)
+		}
+		if !backupRun.UseIfile {
+			utils.Warn.Printf("Backup %s doesn't use ifile. Ignore files have no effect on it.\n", backupRun.Name)
+		}
+		for _, p := range backupRun.Paths {
+			p = filepath.FromSlash(p)
+			if path == p || strings.HasPrefix(path, p+string(os.PathSeparator)) {
+				root = p
+			}
+		}
+		if root == "" {
+			return "", nil, fmt.Errorf("%s is not inside any path of backup %s", path, backupRun.Name)
+		}
+		return root, &ifile.Options{
+			IgnoreFiles: backupRun.IgnoreFiles,
+			GitExcludes: backupRun.GitExcludes,
+			Filters:     backupRun.Filters.IfileFilters(),
+			Markers:     backupRun.Markers,
+
+			FollowSymlinks:   backupRun.FollowSymlinks,
+			OneFileSystem:    backupRun.OneFileSystem,
+			SkipSpecialFiles: backupRun.SkipSpecialFiles,
+		}, nil
+	case ifilePath != "" && backupName == "" && rootFlag == "":
+		run, err := findIfileGenerationRun(ifilePath)
+		if err != nil {
+			return "", nil, err
+		}
+		return filepath.Dir(run.Ifile), ifileOptions(run), nil
+	case rootFlag != "" && backupName == "" && ifilePath == "":
+		root, err = filepath.Abs(rootFlag)
+		return root, nil, err
+	default:
+		return "", nil, fmt.Errorf("specify exactly one of --backup, --ifile or --root")
+	}
+}
+
+func findIfileGenerationRun(ifilePath string) (*_config.IfileGenerationRun, error) {
+	ifilePath, err := filepath.Abs(ifilePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range config.IfileGeneration.Run {
+		if filepath.Clean(run.Ifile) == ifilePath {
+			return run, nil
+		}
+	}
+	return nil, fmt.Errorf("ifile generation run of `%s` not found in config", ifilePath)
+}
+
+// Options of the ifile of an ifile generation run.
+func ifileOptions(run *_config.IfileGenerationRun) *ifile.Options {
+	return &ifile.Options{
+		Workers:     run.WalkWorkers,
+		IgnoreFiles: run.IgnoreFiles,
+		GitExcludes: run.GitExcludes,
+		Filters:     run.Filters.IfileFilters(),
+		Markers:     run.Markers,
+
+		CaseInsensitive: run.CaseInsensitive,
+		Deletable:       run.Deletable,
+	}
+}
+
+// Walk dir, and write the ifile of mode to ifilePath. Lines outside of
+// the I_BEGIN and I_END indicators are kept, except in tar mode, which
+// has no indicators.
+func generateInDir(dir, ifilePath string, mode ifile.Mode) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		errPrintln(err)
+		exit(exitErrAny)
+	}
+	if !stat.IsDir() {
+		errPrintln(fmt.Errorf("not a directory: %s", dir))
+		exit(exitErrAny)
+	}
+
+	fmt.Printf("Creating/opening %s\n", ifilePath)
+	ifile, err := ifile.New(ifilePath, mode, true, debugLog)
+	if err != nil {
+		errPrintln(err)
+		exit(exitErrAny)
+	}
+	// Don't replace the existing ifile with a partial one on panic or interruption.
+	// Close is only called after the walk is done, which makes these no-ops.
+	defer ifile.Discard()
+	addExitHandler(ifile.Discard)
+
+	fmt.Printf("Walking %s\n", dir)
+	err = ifile.Walk(dir)
+	if err != nil {
+		ifile.Discard()
+		errPrintln(err)
+		exit(exitErrAny)
+	}
+	err = ifile.Close()
+	if err != nil {
+		errPrintln(err)
+		exit(exitErrAny)
+	}
+	if ifile.Unchanged() {
+		fmt.Printf("%s is unchanged\n", ifilePath)
+	}
+	printUnreadable(ifile.Unreadable())
+}
+
+// Warn about the directories that couldn't be read, as nothing inside them is in the ifile.
+func printUnreadable(unreadable []ifile.Unreadable) {
+	if len(unreadable) == 0 {
+		return
+	}
+	utils.Warn.Printf("Unreadable directories (skipped): %d\n", len(unreadable))
+	for _, u := range unreadable {
+		fmt.Printf("  %v\n", u.Err)
+	}
+}
@@ -43,6 +43,10 @@ func init() {
 	rootCmd.AddCommand(watchJobCmd)
 	watchJobCmd.AddCommand(watchJobListCmd)
 	watchJobCmd.AddCommand(watchJobStopCmd)
+	watchJobCmd.AddCommand(watchJobStartCmd)
+	watchJobCmd.AddCommand(watchJobRestartCmd)
+	watchJobCmd.AddCommand(watchJobAddCmd)
+	watchJobCmd.AddCommand(watchJobRemoveCmd)
 	rootCmd.AddCommand(doctorCmd)
 	rootCmd.AddCommand(runScript)
 	rootCmd.AddCommand(serviceCmd)
@@ -50,6 +54,11 @@ func init() {
 	rootCmd.AddCommand(ifileCmd)
 	ifileCmd.AddCommand(ifileGenerateCmd)
 	ifileGenerateCmd.AddCommand(ifileGenerateSyncthingCmd)
+	ifileGenerateCmd.AddCommand(ifileGenerateResticCmd)
+	ifileGenerateCmd.AddCommand(ifileGenerateRsyncCmd)
+	ifileGenerateCmd.AddCommand(ifileGenerateTarCmd)
+	ifileCmd.AddCommand(ifileExplainCmd)
+	ifileCmd.AddCommand(ifilePreviewCmd)
 
 	rootCmd.PersistentFlags().StringP("config", "c", "", "Config file")
 	rootCmd.PersistentFlags().Bool("enable-log", false, "Enable debug logging to stdout")
@@ -86,9 +86,20 @@ type svc struct {
 	errsMu    sync.Mutex
 	lock      *flock.Flock
 	log       *zap.Logger
+	// Canceled when the service stops. Work started by the API, such as
+	// backups, derives its context from it.
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	watchJobs []*ifile.WatchJob
 	jobsMu    sync.Mutex
+	// Set before the API server and the watch jobs start, and not changed
+	// afterwards, so that it can be read without a lock.
+	syncthing *syncthingFolders
+
+	backupHistory  []*backupRecord
+	backupsRunning map[string]bool
+	backupsMu      sync.Mutex
 
 	e *echo.Echo
 	s *http.Server
@@ -97,6 +108,7 @@ type svc struct {
 func (s *svc) Start(sv service.Service) (err error) {
 	s.startOnce.Do(func() {
 		s.service = sv
+		s.ctx, s.cancel = context.WithCancel(context.Background())
 
 		err = initEverything()
 		if err != nil {
@@ -114,6 +126,14 @@ func (s *svc) Start(sv service.Service) (err error) {
 		if err != nil {
 			return
 		}
+		s.backupsRunning = make(map[string]bool)
+		err = s.loadBackupHistory()
+		if err != nil {
+			return
+		}
+		if config.IfileGeneration.Syncthing != nil {
+			s.syncthing = newSyncthingFolders(config.IfileGeneration.Syncthing)
+		}
 
 		if config.Service.API.Enabled {
 			var listen func() error
@@ -140,16 +160,10 @@ func (s *svc) Start(sv service.Service) (err error) {
 			return
 		}
 		for _, j := range jobs {
-			go func(j *ifile.WatchJob) {
-				err := j.Run()
-				if err != nil {
-					s.appendErr(fmt.Errorf("watch job: %v", err))
-					err := sv.Stop()
-					if err != nil {
-						s.log.Error(err.Error())
-					}
-				}
-			}(j)
+			go s.runWatchJob(j)
+		}
+		if s.syncthing != nil {
+			s.startSyncthing()
 		}
 
 	})
@@ -219,6 +233,12 @@ func (s *svc) Stop(sv service.Service) (err error) {
 			cancel()
 		}
 
+		if s.cancel != nil {
+			s.cancel()
+		}
+		if s.syncthing != nil {
+			s.syncthing.cancel()
+		}
 		s.jobsMu.Lock()
 		defer s.jobsMu.Unlock()
 		for _, job := range s.watchJobs {
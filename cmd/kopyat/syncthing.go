@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_config "github.com/karagenc/kopyat/internal/config"
+	"github.com/karagenc/kopyat/internal/ifile"
+	"github.com/karagenc/kopyat/internal/syncthing"
+)
+
+const defaultSyncthingRefreshInterval = time.Minute
+
+// Watch jobs of the syncthing folders, which are read from the syncthing REST API.
+type syncthingFolders struct {
+	client *syncthing.Client
+	config *_config.Syncthing
+	// Canceled when the service stops.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// IDs of the folders, by the ifiles of their watch jobs.
+	folders map[string]string
+}
+
+func newSyncthingFolders(st *_config.Syncthing) *syncthingFolders {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &syncthingFolders{
+		client:  syncthing.NewClient(st.APIURL, st.APIKey),
+		config:  st,
+		ctx:     ctx,
+		cancel:  cancel,
+		folders: make(map[string]string),
+	}
+}
+
+// Read the folders from the syncthing REST API, and keep their watch jobs in sync
+// with them until the service stops.
+func (s *svc) startSyncthing() {
+	st := s.syncthing.config
+	ctx := s.syncthing.ctx
+	interval := st.RefreshInterval
+	if interval == 0 {
+		interval = defaultSyncthingRefreshInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			err := s.refreshSyncthingFolders(ctx)
+			if err != nil && ctx.Err() == nil {
+				s.log.Error(fmt.Sprintf("syncthing: %v", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Start the watch jobs of the new folders, and stop the ones of the removed folders.
+func (s *svc) refreshSyncthingFolders(ctx context.Context) error {
+	st := s.syncthing
+	folders, err := st.client.Folders(ctx)
+	if err != nil {
+		return err
+	}
+	selected, missing := syncthing.Select(folders, st.config.Folders)
+	for _, id := range missing {
+		s.log.Warn(fmt.Sprintf("syncthing: no folder with ID: %s", id))
+	}
+
+	current := make(map[string]string, len(selected))
+	for _, folder := range selected {
+		run := st.config.Run
+		run.Ifile = filepath.Join(folder.Path, ".stignore")
+		if run.Mode == "" {
+			run.Mode = ifile.ModeSyncthing.String()
+		}
+		current[run.Ifile] = folder.ID
+
+		st.mu.Lock()
+		_, ok := st.folders[run.Ifile]
+		st.mu.Unlock()
+		if ok {
+			continue
+		} else if s.findWatchJob(run.Ifile) != nil {
+			// There is a watch job for it in config, or an ad-hoc one.
+			continue
+		}
+		if stat, err := os.Stat(folder.Path); err != nil || !stat.IsDir() {
+			s.log.Warn(fmt.Sprintf("syncthing: path of folder %s is not a directory: %s", folder.ID, folder.Path))
+			continue
+		}
+
+		job, err := s.newWatchJob(&run)
+		if err != nil {
+			return fmt.Errorf("folder %s: %v", folder.ID, err)
+		}
+		s.jobsMu.Lock()
+		if ctx.Err() != nil {
+			// The service is stopping.
+			s.jobsMu.Unlock()
+			return nil
+		}
+		s.watchJobs = append(s.watchJobs, job)
+		s.jobsMu.Unlock()
+		st.mu.Lock()
+		st.folders[run.Ifile] = folder.ID
+		st.mu.Unlock()
+		s.log.Info(fmt.Sprintf("syncthing: watching folder %s: %s", folder.ID, folder.Path))
+		go s.runWatchJob(job)
+	}
+
+	st.mu.Lock()
+	var removed []string
+	for path := range st.folders {
+		if _, ok := current[path]; !ok {
+			removed = append(removed, path)
+			delete(st.folders, path)
+		}
+	}
+	st.mu.Unlock()
+	for _, path := range removed {
+		s.removeWatchJob(path)
+		s.log.Info(fmt.Sprintf("syncthing: stopped watching removed folder: %s", filepath.Dir(path)))
+	}
+	return nil
+}
+
+// Whether the watch job with the ifile at path is of a syncthing folder.
+func (s *svc) isSyncthingFolder(path string) bool {
+	st := s.syncthing
+	if st == nil {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, ok := st.folders[path]
+	return ok
+}
+
+// Make syncthing load the regenerated .stignore, and rescan the folder. Errors
+// are only logged, so that the watch job doesn't fail while syncthing is down.
+func (s *svc) notifySyncthing(ifilePath string) {
+	st := s.syncthing
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	id, ok := st.folders[ifilePath]
+	st.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := st.client.Ignores(ctx, id)
+	if err == nil {
+		err = st.client.Rescan(ctx, id)
+	}
+	if err != nil {
+		s.log.Warn(fmt.Sprintf("syncthing: folder %s: %v", id, err))
+	}
+}
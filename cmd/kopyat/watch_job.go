@@ -6,15 +6,16 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"path/filepath"
 
 	"github.com/jedib0t/go-pretty/v6/table"
+	_config "github.com/karagenc/kopyat/internal/config"
 	"github.com/karagenc/kopyat/internal/ifile"
 	"github.com/karagenc/kopyat/internal/scripting/ctx"
 	"github.com/karagenc/kopyat/internal/utils"
 	"github.com/labstack/echo/v4"
 	"github.com/spf13/cobra"
-	"golang.org/x/sync/errgroup"
 )
 
 var (
@@ -50,7 +51,7 @@ var (
 			fmt.Println()
 			w := table.NewWriter()
 			w.AppendHeader(table.Row{
-				"IFILE", "MODE", "ERRORS",
+				"IFILE", "MODE", "STATUS", "WATCHER", "RESTARTS", "UNREADABLE", "ERRORS",
 			})
 			for _, info := range infos {
 				e := ""
@@ -61,7 +62,7 @@ var (
 					}
 				}
 				w.AppendRow(table.Row{
-					info.Ifile, info.Mode, e,
+					info.Ifile, info.Mode, info.Status, info.Watcher, info.Restarts, len(info.Unreadable), e,
 				})
 			}
 			fmt.Println(w.Render())
@@ -74,46 +75,97 @@ var (
 		Short: "Stop a watch job",
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			hc, err := newHTTPClient()
-			if err != nil {
-				errPrintln(err)
-				exit(exitErrAny)
-			}
-			body, err := json.Marshal(args)
-			if err != nil {
-				errPrintln(err)
-				exit(exitErrAny)
-			}
-			resp, err := hc.Post("/watch-job/stop", "application/json", bytes.NewBuffer(body))
-			if err != nil {
-				errPrintln(err)
-				exit(exitErrAny)
-			}
-			defer resp.Body.Close()
-			body, err = io.ReadAll(resp.Body)
-			if err != nil {
-				errPrintln(err)
-				exit(exitErrAny)
-			}
-			var errs []string
-			err = json.Unmarshal(body, &errs)
-			if err != nil {
-				errPrintln(err)
-				exit(exitErrAny)
-			}
+			postWatchJobRequest("/watch-job/stop", args)
+		},
+	}
 
-			if len(errs) > 0 {
-				utils.Error.Println("Errors occured:")
-				for _, err := range errs {
-					fmt.Printf("%s\n", err)
-				}
-				return
-			}
-			utils.Success.Println("Successful")
+	watchJobStartCmd = &cobra.Command{
+		Use:   "start",
+		Short: "Start a stopped or failed watch job",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			postWatchJobRequest("/watch-job/start", args)
+		},
+	}
+
+	watchJobRestartCmd = &cobra.Command{
+		Use:   "restart",
+		Short: "Restart a watch job",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			postWatchJobRequest("/watch-job/restart", args)
+		},
+	}
+
+	watchJobRemoveCmd = &cobra.Command{
+		Use:   "remove",
+		Short: "Stop and remove an ad-hoc watch job",
+		Long:  "Stop and remove an ad-hoc watch job, and forget it if it is persisted. Watch jobs in config file can't be removed.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			postWatchJobRequest("/watch-job/remove", args)
+		},
+	}
+
+	watchJobAddCmd = &cobra.Command{
+		Use:   "add",
+		Short: "Add a watch job generating .stignore for a directory",
+		Long:  "Add a watch job generating .stignore for a directory. Directory path must be absolute.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			persist, _ := cmd.Flags().GetBool("persist")
+			postWatchJobRequest("/watch-job", &addWatchJobRequest{
+				Dir:     args[0],
+				Persist: persist,
+			})
 		},
 	}
 )
 
+func init() {
+	watchJobAddCmd.Flags().Bool("persist", false, "Keep the watch job across restarts of the service")
+}
+
+// Post v as JSON, and print the errors that are returned.
+func postWatchJobRequest(path string, v any) {
+	hc, err := newHTTPClient()
+	if err != nil {
+		errPrintln(err)
+		exit(exitErrAny)
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		errPrintln(err)
+		exit(exitErrAny)
+	}
+	resp, err := hc.Post(path, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		errPrintln(err)
+		exit(exitErrAny)
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		errPrintln(err)
+		exit(exitErrAny)
+	}
+	var errs []string
+	err = json.Unmarshal(body, &errs)
+	if err != nil {
+		errPrintln(err)
+		exit(exitErrAny)
+	}
+
+	if len(errs) > 0 {
+		utils.Error.Println("Errors occured:")
+		for _, err := range errs {
+			fmt.Printf("%s\n", err)
+		}
+		return
+	}
+	utils.Success.Println("Successful")
+}
+
 func (s *svc) getWatchJobs(c echo.Context) error {
 	s.jobsMu.Lock()
 	watchJobs := s.watchJobs
@@ -127,6 +179,17 @@ func (s *svc) getWatchJobs(c echo.Context) error {
 	return c.JSON(http.StatusOK, infos)
 }
 
+func (s *svc) findWatchJob(ifile string) *ifile.WatchJob {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	for _, job := range s.watchJobs {
+		if job.Ifile() == ifile {
+			return job
+		}
+	}
+	return nil
+}
+
 func (s *svc) stopWatchJobs(c echo.Context) error {
 	var ifiles []string
 	err := c.Bind(&ifiles)
@@ -134,59 +197,346 @@ func (s *svc) stopWatchJobs(c echo.Context) error {
 		return err
 	}
 
-	s.jobsMu.Lock()
-	errGroup := errgroup.Group{}
-	for _, ifile := range ifiles {
-		for i, job := range s.watchJobs {
-			job := job
-			if job.Ifile() == ifile {
-				s.watchJobs = append(s.watchJobs[:i], s.watchJobs[i+1:]...)
-				errGroup.Go(func() error { return job.Shutdown() })
-			}
+	errs := make([]string, 0)
+	for _, path := range ifiles {
+		job := s.findWatchJob(path)
+		if job == nil {
+			errs = append(errs, fmt.Sprintf("no watch job with ifile: %s", path))
+			continue
+		}
+		err := job.Shutdown()
+		if err != nil {
+			errs = append(errs, err.Error())
 		}
 	}
-	s.jobsMu.Unlock()
+	return c.JSON(http.StatusOK, errs)
+}
+
+func (s *svc) startWatchJobs(c echo.Context) error {
+	var ifiles []string
+	err := c.Bind(&ifiles)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]string, 0)
+	for _, path := range ifiles {
+		job := s.findWatchJob(path)
+		if job == nil {
+			errs = append(errs, fmt.Sprintf("no watch job with ifile: %s", path))
+			continue
+		}
+		err := job.Start(func(err error) { s.watchJobExited(job, err) })
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %s", err, path))
+		}
+	}
+	return c.JSON(http.StatusOK, errs)
+}
+
+func (s *svc) restartWatchJobs(c echo.Context) error {
+	var ifiles []string
+	err := c.Bind(&ifiles)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]string, 0)
+	for _, path := range ifiles {
+		job := s.findWatchJob(path)
+		if job == nil {
+			errs = append(errs, fmt.Sprintf("no watch job with ifile: %s", path))
+			continue
+		}
+		err := job.Shutdown()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		go func() {
+			job.Wait()
+			s.runWatchJob(job)
+		}()
+	}
+	return c.JSON(http.StatusOK, errs)
+}
+
+type (
+	addWatchJobRequest struct {
+		Dir string `json:"dir"`
+		// Keep the watch job across restarts of the service.
+		Persist bool `json:"persist"`
+	}
+
+	// Ad-hoc watch job that is kept across restarts of the service.
+	persistedWatchJob struct {
+		Ifile string `json:"ifile"`
+		Mode  string `json:"mode"`
+	}
+)
+
+const persistedWatchJobsFileName = "watch_jobs.json"
 
-	err = errGroup.Wait()
+func (s *svc) addWatchJob(c echo.Context) error {
+	var req addWatchJobRequest
+	err := c.Bind(&req)
+	if err != nil {
+		return err
+	}
+
+	if !filepath.IsAbs(req.Dir) {
+		return c.JSON(http.StatusOK, []string{fmt.Sprintf("directory path `%s` is not absolute", req.Dir)})
+	}
+	stat, err := os.Stat(req.Dir)
 	if err != nil {
 		return c.JSON(http.StatusOK, []string{err.Error()})
+	} else if !stat.IsDir() {
+		return c.JSON(http.StatusOK, []string{fmt.Sprintf("not a directory: %s", req.Dir)})
 	}
+
+	run, err := adHocWatchJobRun(filepath.Join(req.Dir, ".stignore"), "")
+	if err != nil {
+		return c.JSON(http.StatusOK, []string{err.Error()})
+	}
+	// Hold the lock from the duplicate check until the job is added, so that
+	// concurrent requests for the same directory don't both start a job.
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	for _, j := range s.watchJobs {
+		if j.Ifile() == run.Ifile {
+			return c.JSON(http.StatusOK, []string{fmt.Sprintf("a watch job with ifile %s already exists", run.Ifile)})
+		}
+	}
+	job, err := s.newWatchJob(run)
+	if err != nil {
+		return c.JSON(http.StatusOK, []string{err.Error()})
+	}
+
+	if req.Persist {
+		persisted, err := readPersistedWatchJobs()
+		if err != nil {
+			return c.JSON(http.StatusOK, []string{err.Error()})
+		}
+		// It can already be there if it failed to load when the service started.
+		found := false
+		for _, p := range persisted {
+			if p.Ifile == run.Ifile {
+				found = true
+				break
+			}
+		}
+		if !found {
+			persisted = append(persisted, &persistedWatchJob{Ifile: run.Ifile, Mode: run.Mode})
+			err = writePersistedWatchJobs(persisted)
+			if err != nil {
+				return c.JSON(http.StatusOK, []string{err.Error()})
+			}
+		}
+	}
+
+	s.watchJobs = append(s.watchJobs, job)
+	go s.runWatchJob(job)
 	return c.JSON(http.StatusOK, []string{})
 }
 
-func (s *svc) initWatchJobs() (jobs []*ifile.WatchJob, err error) {
-	for _, run := range config.IfileGeneration.Run {
-		newHookRunner := func(hooks []string, c ctx.Context) func() error {
-			return func() error {
-				errGroup := &errgroup.Group{}
-				for _, hook := range hooks {
-					err := runHook(errGroup, hook, c)
-					if err != nil {
-						return err
-					}
+func (s *svc) removeWatchJobs(c echo.Context) error {
+	var ifiles []string
+	err := c.Bind(&ifiles)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]string, 0)
+	for _, path := range ifiles {
+		if isConfiguredWatchJob(path) {
+			errs = append(errs, fmt.Sprintf("watch job is in config file. remove it from there: %s", path))
+			continue
+		} else if s.isSyncthingFolder(path) {
+			errs = append(errs, fmt.Sprintf("watch job belongs to a syncthing folder. remove the folder from `folders`: %s", path))
+			continue
+		}
+		removed := s.removeWatchJob(path)
+
+		s.jobsMu.Lock()
+		persisted, err := readPersistedWatchJobs()
+		if err == nil {
+			kept := persisted[:0]
+			for _, p := range persisted {
+				if p.Ifile == path {
+					removed = true
+				} else {
+					kept = append(kept, p)
 				}
-				return errGroup.Wait()
+			}
+			if len(kept) != len(persisted) {
+				err = writePersistedWatchJobs(kept)
 			}
 		}
+		s.jobsMu.Unlock()
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else if !removed {
+			errs = append(errs, fmt.Sprintf("no watch job with ifile: %s", path))
+		}
+	}
+	return c.JSON(http.StatusOK, errs)
+}
 
-		runPreHooks := newHookRunner(run.Hooks.Pre, ctx.NewIfileGenerationContext(true, run.Ifile, run.Mode))
-		runPostHooks := newHookRunner(run.Hooks.Post, ctx.NewIfileGenerationContext(false, run.Ifile, run.Mode))
+// Shut down the watch job with the ifile at path, and remove it. Return whether there was one.
+func (s *svc) removeWatchJob(path string) bool {
+	s.jobsMu.Lock()
+	var job *ifile.WatchJob
+	for i, j := range s.watchJobs {
+		if j.Ifile() == path {
+			job = j
+			s.watchJobs = append(s.watchJobs[:i], s.watchJobs[i+1:]...)
+			break
+		}
+	}
+	s.jobsMu.Unlock()
+	if job == nil {
+		return false
+	}
+	err := job.Shutdown()
+	if err != nil {
+		s.log.Error(err.Error())
+	}
+	return true
+}
 
-		var mode ifile.Mode
-		switch run.Mode {
-		case "syncthing":
-			mode = ifile.ModeSyncthing
-		default:
-			if run.Mode == "" {
-				return nil, fmt.Errorf("empty `mode` field. check config")
+func isConfiguredWatchJob(ifilePath string) bool {
+	for _, run := range config.IfileGeneration.Run {
+		if run.Ifile == ifilePath {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the run of an ad-hoc watch job, with the defaults applied. It is checked
+// like the runs in config file. mode defaults to syncthing.
+func adHocWatchJobRun(ifilePath, mode string) (*_config.IfileGenerationRun, error) {
+	if mode == "" {
+		mode = ifile.ModeSyncthing.String()
+	}
+	run := &_config.IfileGenerationRun{
+		Ifile: filepath.Clean(ifilePath),
+		Mode:  mode,
+	}
+	err := _config.CheckIfileGenerationRun(run)
+	if err != nil {
+		return nil, err
+	}
+	_, err = ifileMode(run.Mode)
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+func readPersistedWatchJobs() (persisted []*persistedWatchJob, err error) {
+	content, err := os.ReadFile(filepath.Join(stateDir, persistedWatchJobsFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &persisted)
+	return
+}
+
+func writePersistedWatchJobs(persisted []*persistedWatchJob) error {
+	content, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stateDir, persistedWatchJobsFileName), content, 0644)
+}
+
+func (s *svc) runWatchJob(job *ifile.WatchJob) {
+	s.watchJobExited(job, job.Run())
+}
+
+// Handle the error of a run of job, after it returns.
+func (s *svc) watchJobExited(job *ifile.WatchJob, err error) {
+	if err == ifile.ErrWatchJobRunning {
+		s.log.Warn(fmt.Sprintf("watch job: %s: %v", job.Ifile(), err))
+	} else if err != nil {
+		if config.Service.OnWatchJobFailure == _config.WatchJobFailureMarkFailed {
+			s.log.Error(fmt.Sprintf("watch job: %s: %v", job.Ifile(), err))
+			return
+		}
+		s.appendErr(fmt.Errorf("watch job: %v", err))
+		err := s.service.Stop()
+		if err != nil {
+			s.log.Error(err.Error())
+		}
+	}
+}
+
+func (s *svc) newWatchJob(run *_config.IfileGenerationRun) (*ifile.WatchJob, error) {
+	var job *ifile.WatchJob
+	runPreHooks := newHookRunner(run.Hooks.Pre, ctx.NewIfileGenerationContext(true, run.Ifile, run.Mode, false))
+	runPostHooks := func() error {
+		c := ctx.NewIfileGenerationContext(false, run.Ifile, run.Mode, job.Unchanged())
+		err := newHookRunner(run.Hooks.Post, c)()
+		if err == nil && !job.Unchanged() {
+			s.notifySyncthing(run.Ifile)
+		}
+		return err
+	}
+
+	mode, err := ifileMode(run.Mode)
+	if err != nil {
+		return nil, err
+	}
+	opts := &ifile.WatchJobOptions{
+		RestartPolicy: ifile.RestartPolicy{
+			OnFailure:   run.Restart.Policy == _config.RestartPolicyOnFailure,
+			MaxAttempts: run.Restart.MaxAttempts,
+			Backoff:     run.Restart.Backoff,
+			MaxBackoff:  run.Restart.MaxBackoff,
+		},
+		Debounce:     run.Debounce,
+		MaxDelay:     run.MaxDelay,
+		Poll:         run.Watcher == _config.WatcherPoll,
+		PollInterval: run.PollInterval,
+
+		Incremental:    run.Incremental,
+		ResyncInterval: run.ResyncInterval,
+		Ifile:          *ifileOptions(run),
+	}
+	job = ifile.NewWatchJobWithOptions(run.Ifile, filepath.Dir(run.Ifile), mode, opts, runPreHooks, runPostHooks, s.log)
+	return job, nil
+}
+
+func (s *svc) initWatchJobs() (jobs []*ifile.WatchJob, err error) {
+	persisted, err := readPersistedWatchJobs()
+	if err != nil {
+		return nil, fmt.Errorf("reading persisted watch jobs: %v", err)
+	}
+	runs := append([]*_config.IfileGenerationRun{}, config.IfileGeneration.Run...)
+outer:
+	for _, p := range persisted {
+		for _, run := range runs {
+			if run.Ifile == p.Ifile {
+				continue outer
 			}
-			return nil, fmt.Errorf("invalid `mode` field: %s", run.Mode)
 		}
+		run, err := adHocWatchJobRun(p.Ifile, p.Mode)
+		if err != nil {
+			// Don't fail the service. It can be removed with `kopyat watch-job remove`.
+			s.log.Error(fmt.Sprintf("persisted watch job %s: %v", p.Ifile, err))
+			continue
+		}
+		runs = append(runs, run)
+	}
 
+	for _, run := range runs {
 		var job *ifile.WatchJob
 		s.jobsMu.Lock()
 		for i, j := range s.watchJobs {
-			if run.Ifile == job.Ifile() {
+			if run.Ifile == j.Ifile() {
 				job = j
 				s.watchJobs = append(s.watchJobs[:i], s.watchJobs[i+1:]...)
 				break
@@ -200,7 +550,10 @@ func (s *svc) initWatchJobs() (jobs []*ifile.WatchJob, err error) {
 			}
 		}
 
-		job = ifile.NewWatchJob(run.Ifile, filepath.Dir(run.Ifile), mode, runPreHooks, runPostHooks, s.log)
+		job, err = s.newWatchJob(run)
+		if err != nil {
+			return nil, err
+		}
 
 		jobs = append(jobs, job)
 		s.jobsMu.Lock()
@@ -209,3 +562,21 @@ func (s *svc) initWatchJobs() (jobs []*ifile.WatchJob, err error) {
 	}
 	return
 }
+
+// Return the mode of an ifile generation run.
+func ifileMode(mode string) (ifile.Mode, error) {
+	switch mode {
+	case "syncthing":
+		return ifile.ModeSyncthing, nil
+	case "syncthing-patterns":
+		return ifile.ModeSyncthingPatterns, nil
+	case "rsync":
+		return ifile.ModeRsync, nil
+	case "tar":
+		return ifile.ModeTar, nil
+	case "":
+		return 0, fmt.Errorf("empty `mode` field. check config")
+	default:
+		return 0, fmt.Errorf("invalid `mode` field: %s", mode)
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/karagenc/kopyat/internal/backup/provider"
 	"github.com/karagenc/kopyat/internal/config"
+	"github.com/karagenc/kopyat/internal/ifile"
 	"github.com/karagenc/kopyat/internal/utils"
 )
 
@@ -106,6 +107,19 @@ func fromConfig(
 		backup:   backup,
 		base:     config.Base,
 		paths:    config.Paths,
+
+		ifileMode:   ifileMode(config.IfileMode),
+		walkWorkers: config.WalkWorkers,
+		ignoreFiles: config.IgnoreFiles,
+		gitExcludes: config.GitExcludes,
+		filters:     config.Filters.IfileFilters(),
+		markers:     config.Markers,
+
+		onUnreadable: config.OnUnreadable,
+
+		followSymlinks:   config.FollowSymlinks,
+		oneFileSystem:    config.OneFileSystem,
+		skipSpecialFiles: config.SkipSpecialFiles,
 	}
 	err = backup.Paths.check()
 	if err != nil {
@@ -114,6 +128,28 @@ func fromConfig(
 	return
 }
 
+func ifileMode(mode string) ifile.Mode {
+	if mode == config.IfileModeExclude {
+		return ifile.ModeResticExclude
+	}
+	return ifile.ModeRestic
+}
+
+// Warn about the directories that couldn't be read while generating the
+// ifile, unless `on_unreadable` is `skip`.
+func (b *Backup) warnUnreadable() {
+	if b.Config.OnUnreadable == config.OnUnreadableSkip {
+		return
+	}
+	for _, u := range b.Paths.Unreadable() {
+		b.log.Sugar().Warnf("Backup %s: skipped unreadable directory: %v", b.Name, u.Err)
+		if !b.asService {
+			utils.Warn.Print("Skipped unreadable directory: ")
+			fmt.Println(u.Err)
+		}
+	}
+}
+
 func (b *Backup) Do() error {
 	if !b.UseIfile {
 		paths := b.Paths.Paths()
@@ -149,13 +185,20 @@ func (b *Backup) Do() error {
 			}
 		}
 	} else {
-		err := b.Paths.generateIfile()
-		defer os.Remove(b.Paths.ifilePath())
+		err := b.Paths.GenerateIfile(b.Paths.IfilePath())
+		if !b.Config.KeepIfile {
+			defer os.Remove(b.Paths.IfilePath())
+		}
 		if err != nil {
 			return err
 		}
+		b.warnUnreadable()
 
-		err = b.Provider.BackupWithIfile(b.Paths.ifilePath())
+		if b.Paths.ifileMode == ifile.ModeResticExclude {
+			err = b.Provider.BackupWithIfile(b.Paths.IfilePath(), b.Paths.Paths()...)
+		} else {
+			err = b.Provider.BackupWithIfile(b.Paths.IfilePath())
+		}
 		if err != nil {
 			return err
 		}
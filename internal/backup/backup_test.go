@@ -171,6 +171,127 @@ func TestGitignoreToRestic(t *testing.T) {
 	}
 }
 
+// Make sure the ifile passed to restic has the entries it should, for each ifile mode.
+func TestIfileToRestic(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		ifileMode string
+		// Contents of the files, by their paths relative to the documents directory.
+		files                 map[string]string
+		mustHave, mustNotHave []string
+	}{
+		{
+			// The entries included by .kopyatinclude are listed, even if they are
+			// excluded by a .gitignore.
+			name:      "kopyatinclude",
+			ifileMode: config.IfileModeInclude,
+			files: map[string]string{
+				".gitignore":     ".env\n*.db\nsecrets/\nbuild/\n",
+				".kopyatinclude": ".env\nsecrets/\nbuild/keep\n",
+				".env":           "",
+				"local.db":       "",
+				"secrets/key":    "",
+				"build/out":      "",
+				"build/keep":     "",
+				// Closer files take precedence.
+				"sub/.gitignore":     ".env\n",
+				"sub/.env":           "",
+				"sub/.kopyatinclude": "app.db\n",
+				"sub/app.db":         "",
+			},
+			mustHave: []string{
+				"/documents/.env",
+				"/documents/secrets/key",
+				"/documents/build/keep",
+				"/documents/sub/app.db",
+			},
+			mustNotHave: []string{
+				"/documents/local.db",
+				"/documents/build",
+				"/documents/build/out",
+				"/documents/sub/.env",
+			},
+		},
+		{
+			// The exclude file has the patterns of the ignore files, anchored at
+			// their directories. .kopyatinclude patterns are negated.
+			name:      "exclude-file",
+			ifileMode: config.IfileModeExclude,
+			files: map[string]string{
+				".gitignore":          "*.log\nbuild/\n",
+				".kopyatinclude":      "build/keep\n",
+				"notes.txt":           "",
+				"debug.log":           "",
+				"cache/huge":          "",
+				"cache/.kopyatignore": "*\n",
+				"build/out":           "",
+				"build/keep":          "",
+			},
+			mustHave: []string{
+				"/documents/*.log",
+				"/documents/**/*.log",
+				"/documents/build/**",
+				"/documents/**/build/**",
+				"!/documents/build/keep",
+				"/documents/cache/*",
+				"/documents/cache/**/*",
+			},
+			mustNotHave: []string{
+				"/documents",
+				"/documents/notes.txt",
+				"/documents/debug.log",
+				"/documents/build/out",
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			basePath := filepath.ToSlash(t.TempDir())
+			for path, content := range c.files {
+				mustCreateFile(basePath+"/documents/"+path, content)
+			}
+			lines := generateIfileLines(t, basePath, c.ifileMode)
+			for _, have := range c.mustHave {
+				require.Contains(t, lines, have)
+			}
+			for _, notHave := range c.mustNotHave {
+				require.NotContains(t, lines, notHave)
+			}
+		})
+	}
+}
+
+// Generate the ifile of a backup of basePath/documents, and return its lines without basePath.
+func generateIfileLines(t *testing.T, basePath, ifileMode string) []string {
+	configBackups := &config.Backups{
+		Run: []*config.BackupRun{
+			{
+				Name:      "test",
+				UseIfile:  true,
+				IfileMode: ifileMode,
+				Restic:    &config.Restic{Repo: filepath.Join(basePath, "repo")},
+				Base:      basePath,
+				Paths: []string{
+					"documents",
+				},
+			},
+		},
+	}
+
+	backups, err := FromConfig(context.Background(), configBackups, t.TempDir(), zap.NewNop(), false)
+	require.NoError(t, err)
+	p := backups["test"].Paths
+	err = p.GenerateIfile(p.IfilePath())
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(p.IfilePath())
+	require.NoError(t, err)
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Replace(line, basePath, "", 1)
+	}
+	return lines
+}
+
 func testRunRestic(
 	repoPath, command, extraArgs, password string,
 	wr io.Writer,
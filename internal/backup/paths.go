@@ -1,15 +1,14 @@
 package backup
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/karagenc/kopyat/internal/config"
 	"github.com/karagenc/kopyat/internal/ifile"
 	"go.uber.org/zap"
-	"golang.org/x/sync/errgroup"
 )
 
 type paths struct {
@@ -19,6 +18,26 @@ type paths struct {
 	backup *Backup
 	base   string
 	paths  []string
+	// ModeRestic (include list) or ModeResticExclude.
+	ifileMode ifile.Mode
+	// Number of directories to walk concurrently while generating the ifile.
+	walkWorkers int
+	// Names of the ignore files. Empty means the default ones.
+	ignoreFiles []string
+	// Read git's excludes files in git repositories too.
+	gitExcludes bool
+	// Exclude files by their size, age and type too.
+	filters *ifile.Filters
+	// Directories that contain one of these files are excluded.
+	markers []string
+	// `on_unreadable` of the backup.
+	onUnreadable string
+	// Directories that couldn't be read while generating the ifile.
+	unreadable []ifile.Unreadable
+	// See ifile.Options.
+	followSymlinks   bool
+	oneFileSystem    bool
+	skipSpecialFiles bool
 }
 
 func (p *paths) Paths() []string { return p.paths }
@@ -75,24 +94,68 @@ func checkPathCollision(paths []string) error {
 	return nil
 }
 
-func (p *paths) ifilePath() string {
+// IfilePath is where the ifile is generated before the backup. It is
+// removed after the backup, unless `keep_ifile` is set.
+func (p *paths) IfilePath() string {
 	return filepath.Join(p.cacheDir, p.backup.Name+".list")
 }
 
-func (p *paths) generateIfile() error {
-	g, _ := errgroup.WithContext(context.Background())
+func (p *paths) ifileOptions() *ifile.Options {
+	return &ifile.Options{
+		Workers:     p.walkWorkers,
+		Stream:      true,
+		IgnoreFiles: p.ignoreFiles,
+		GitExcludes: p.gitExcludes,
+		Filters:     p.filters,
+		Markers:     p.markers,
+
+		FailOnUnreadable: p.onUnreadable == config.OnUnreadableFail,
+		FollowSymlinks:   p.followSymlinks,
+		OneFileSystem:    p.oneFileSystem,
+		SkipSpecialFiles: p.skipSpecialFiles,
+	}
+}
 
-	i, err := ifile.New(p.ifilePath(), ifile.ModeRestic, false, p.log)
+// GenerateIfile generates the ifile at filePath.
+//
+// Paths are walked one after another, so that the ifile is the same on each
+// generation. Directories inside them are walked concurrently by walkWorkers.
+// The ifile can get large, so it is streamed to disk.
+func (p *paths) GenerateIfile(filePath string) error {
+	i, err := ifile.NewWithOptions(filePath, p.ifileMode, false, p.ifileOptions(), p.log)
 	if err != nil {
 		return err
 	}
-	defer i.Close()
 
 	for _, path := range p.Paths() {
-		path := path
-		g.Go(func() error {
-			return i.Walk(path)
-		})
+		err = i.Walk(path)
+		if err != nil {
+			i.Discard()
+			return err
+		}
+	}
+	p.unreadable = i.Unreadable()
+	return i.Close()
+}
+
+// Unreadable returns the directories that couldn't be read, and were skipped,
+// by the last generation of the ifile.
+func (p *paths) Unreadable() []ifile.Unreadable { return p.unreadable }
+
+// Preview generates the ifile at filePath instead, and counts the included and
+// excluded files.
+func (p *paths) Preview(filePath string) (totals ifile.Totals, err error) {
+	i, err := ifile.NewWithOptions(filePath, p.ifileMode, false, p.ifileOptions(), p.log)
+	if err != nil {
+		return
+	}
+	for _, path := range p.Paths() {
+		pathTotals, err := i.WalkWithTotals(path)
+		if err != nil {
+			i.Discard()
+			return totals, err
+		}
+		totals.Add(pathTotals)
 	}
-	return g.Wait()
+	return totals, i.Close()
 }
@@ -4,6 +4,8 @@ type Provider interface {
 	Init() error
 	TargetPath() string
 	Backup(path string) error
-	BackupWithIfile(ifile string) error
+	// If paths are given, ifile is an exclude file, and paths are backed up except
+	// what it excludes. Otherwise, ifile is the list of the files to back up.
+	BackupWithIfile(ifile string, paths ...string) error
 	PasswordIsSet() bool
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/mattn/go-shellwords"
 	"go.uber.org/zap"
@@ -42,26 +43,40 @@ func NewRestic(
 func (r *Restic) TargetPath() string { return r.repoPath }
 
 func (r *Restic) Init() error {
-	return r.run(fmt.Sprintf("restic -r '%s' init", r.repoPath))
+	return r.run(fmt.Sprintf("restic -r %s init", quote(r.repoPath)))
 }
 
 func (r *Restic) Backup(path string) error {
 	path = filepath.ToSlash(path)
-	command := fmt.Sprintf("restic -r '%s' backup", r.repoPath)
+	command := fmt.Sprintf("restic -r %s backup", quote(r.repoPath))
 	if r.extraArgs != "" {
 		command += " " + r.extraArgs
 	}
-	command += " " + path
+	command += " " + quote(path)
 	return r.run(command)
 }
 
-func (r *Restic) BackupWithIfile(ifile string) error {
+func (r *Restic) BackupWithIfile(ifile string, paths ...string) error {
 	ifile = filepath.ToSlash(ifile)
-	command := fmt.Sprintf("restic -r '%s' backup", r.repoPath)
+	command := fmt.Sprintf("restic -r %s backup", quote(r.repoPath))
 	if r.extraArgs != "" {
 		command += " " + r.extraArgs
 	}
-	return r.run(fmt.Sprintf("%s --files-from %s", command, ifile))
+	if len(paths) == 0 {
+		return r.run(fmt.Sprintf("%s --files-from %s", command, quote(ifile)))
+	}
+	command += " --exclude-file " + quote(ifile)
+	for _, path := range paths {
+		command += " " + quote(filepath.ToSlash(path))
+	}
+	return r.run(command)
+}
+
+// Quote s as a single word of the command. Inside single quotes, the parser
+// still expands environment variables and drops backslashes, so they are escaped.
+func quote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "$", `\$`, "`", "\\`", "'", `'\''`).Replace(s)
+	return "'" + s + "'"
 }
 
 func (r *Restic) PasswordIsSet() bool {
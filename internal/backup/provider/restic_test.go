@@ -0,0 +1,27 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/mattn/go-shellwords"
+	"github.com/stretchr/testify/require"
+)
+
+// Make sure the quoted paths are parsed back as they are, as a single word.
+func TestQuote(t *testing.T) {
+	parser := shellwords.NewParser()
+	parser.ParseBacktick = true
+	parser.ParseEnv = true
+	for _, path := range []string{
+		"/home/user/My Documents",
+		"/home/user/it's",
+		`/home/user/back\slash`,
+		"/home/user/$HOME",
+		"/home/user/`date`",
+		`/home/user/"quoted"`,
+	} {
+		w, err := parser.Parse("restic backup " + quote(path))
+		require.NoError(t, err)
+		require.Equal(t, []string{"restic", "backup", path}, w)
+	}
+}
@@ -9,7 +9,20 @@ type (
 		Name   string  `mapstructure:"name"`
 		Restic *Restic `mapstructure:"restic"`
 
-		UseIfile bool `mapstructure:"use_ifile"`
+		UseIfile    bool     `mapstructure:"use_ifile"`
+		IfileMode   string   `mapstructure:"ifile_mode"`
+		KeepIfile   bool     `mapstructure:"keep_ifile"`
+		WalkWorkers int      `mapstructure:"walk_workers"`
+		IgnoreFiles []string `mapstructure:"ignore_files"`
+		GitExcludes bool     `mapstructure:"git_excludes"`
+		Filters     *Filters `mapstructure:"filters"`
+		Markers     []string `mapstructure:"markers"`
+		// What to do with directories that can't be read while generating the ifile.
+		OnUnreadable string `mapstructure:"on_unreadable"`
+
+		FollowSymlinks   bool `mapstructure:"follow_symlinks"`
+		OneFileSystem    bool `mapstructure:"one_file_system"`
+		SkipSpecialFiles bool `mapstructure:"skip_special_files"`
 
 		Hooks     Hooks     `mapstructure:"hooks"`
 		Reminders Reminders `mapstructure:"reminders"`
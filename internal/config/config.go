@@ -7,8 +7,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
@@ -21,13 +23,54 @@ type (
 	}
 
 	IfileGeneration struct {
-		Run []*IfileGenerationRun `mapstructure:"run"`
+		Run       []*IfileGenerationRun `mapstructure:"run"`
+		Syncthing *Syncthing            `mapstructure:"syncthing"`
+	}
+
+	// Watch jobs of syncthing folders, which are read from the syncthing REST API.
+	Syncthing struct {
+		APIURL string `mapstructure:"api_url"`
+		APIKey string `mapstructure:"api_key"`
+		// IDs of the folders, or `all`.
+		Folders []string `mapstructure:"folders"`
+		// How often the folders are read again, to pick up added and removed ones.
+		RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+
+		// Settings of the watch jobs. `ifile` is the .stignore of each folder.
+		Run IfileGenerationRun `mapstructure:",squash"`
 	}
 
 	IfileGenerationRun struct {
-		Ifile string `mapstructure:"ifile"`
-		Mode  string `mapstructure:"mode"`
-		Hooks Hooks  `mapstructure:"hooks"`
+		Ifile   string  `mapstructure:"ifile"`
+		Mode    string  `mapstructure:"mode"`
+		Hooks   Hooks   `mapstructure:"hooks"`
+		Restart Restart `mapstructure:"restart"`
+
+		Debounce time.Duration `mapstructure:"debounce"`
+		MaxDelay time.Duration `mapstructure:"max_delay"`
+
+		Watcher      string        `mapstructure:"watcher"`
+		PollInterval time.Duration `mapstructure:"poll_interval"`
+
+		Incremental    bool          `mapstructure:"incremental"`
+		ResyncInterval time.Duration `mapstructure:"resync_interval"`
+
+		WalkWorkers int      `mapstructure:"walk_workers"`
+		IgnoreFiles []string `mapstructure:"ignore_files"`
+		GitExcludes bool     `mapstructure:"git_excludes"`
+		Filters     *Filters `mapstructure:"filters"`
+		Markers     []string `mapstructure:"markers"`
+
+		// Only for the `syncthing-patterns` mode.
+		CaseInsensitive bool `mapstructure:"case_insensitive"`
+		Deletable       bool `mapstructure:"deletable"`
+	}
+
+	Restart struct {
+		Policy      string        `mapstructure:"policy"`
+		MaxAttempts int           `mapstructure:"max_attempts"`
+		Backoff     time.Duration `mapstructure:"backoff"`
+		MaxBackoff  time.Duration `mapstructure:"max_backoff"`
 	}
 
 	Hooks struct {
@@ -41,6 +84,27 @@ type (
 	}
 )
 
+const (
+	RestartPolicyNever     = "never"
+	RestartPolicyOnFailure = "on-failure"
+)
+
+const (
+	IfileModeInclude = "include"
+	IfileModeExclude = "exclude"
+)
+
+const (
+	OnUnreadableSkip = "skip"
+	OnUnreadableWarn = "warn"
+	OnUnreadableFail = "fail"
+)
+
+const (
+	WatcherFsnotify = "fsnotify"
+	WatcherPoll     = "poll"
+)
+
 func DirsLocal() []string {
 	home, err := homedir.Dir()
 	if err != nil {
@@ -101,7 +165,11 @@ func Read(configFile, userConfigDir, systemConfigDir string) (
 		return
 	}
 	config = new(Config)
-	err = v.Unmarshal(config)
+	err = v.Unmarshal(config, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		filtersDecodeHook(),
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)))
 	if err != nil {
 		return
 	}
@@ -156,6 +224,17 @@ func (c *Config) PlaceEnvironmentVariables() error {
 		}
 	}
 
+	if st := c.IfileGeneration.Syncthing; st != nil {
+		replace(&st.APIURL)
+		replace(&st.APIKey)
+		for j := range st.Run.Hooks.Pre {
+			replace(&st.Run.Hooks.Pre[j])
+		}
+		for j := range st.Run.Hooks.Post {
+			replace(&st.Run.Hooks.Post[j])
+		}
+	}
+
 	for i := range c.Backups.Run {
 		replace(&c.Backups.Run[i].Restic.Repo)
 		replace(&c.Backups.Run[i].Restic.ExtraArgs)
@@ -206,6 +285,32 @@ func (c *Config) CheckNonService() error {
 			path = filepath.ToSlash(path)
 			run.Paths[i] = path
 		}
+		if run.WalkWorkers < 0 {
+			return fmt.Errorf("negative `walk_workers` for backup %s", run.Name)
+		}
+		switch run.IfileMode {
+		case "", IfileModeInclude, IfileModeExclude:
+		default:
+			return fmt.Errorf("invalid `ifile_mode` `%s` for backup %s. valid modes are: %s and %s", run.IfileMode, run.Name, IfileModeInclude, IfileModeExclude)
+		}
+		switch run.OnUnreadable {
+		case "", OnUnreadableSkip, OnUnreadableWarn, OnUnreadableFail:
+		default:
+			return fmt.Errorf("invalid `on_unreadable` `%s` for backup %s. valid values are: %s, %s and %s", run.OnUnreadable, run.Name, OnUnreadableSkip, OnUnreadableWarn, OnUnreadableFail)
+		}
+		err := checkFileNames(run.IgnoreFiles, "ignore_files")
+		if err == nil {
+			err = checkFileNames(run.Markers, "markers")
+		}
+		if err != nil {
+			return fmt.Errorf("%v for backup %s", err, run.Name)
+		}
+		if run.Filters != nil {
+			err = run.Filters.check()
+			if err != nil {
+				return fmt.Errorf("%v for backup %s", err, run.Name)
+			}
+		}
 	}
 	return nil
 }
@@ -230,12 +335,112 @@ func (c *Config) CheckService() error {
 		}
 	}
 
+	switch c.Service.OnWatchJobFailure {
+	case "", WatchJobFailureStopService, WatchJobFailureMarkFailed:
+	default:
+		return fmt.Errorf("invalid `on_watch_job_failure` field: %s. valid values are: %s and %s", c.Service.OnWatchJobFailure, WatchJobFailureStopService, WatchJobFailureMarkFailed)
+	}
+
 	for _, run := range c.IfileGeneration.Run {
-		if run.Ifile == "" {
-			return fmt.Errorf("empty ifile path. remove it or set it to a file in config file")
+		err := CheckIfileGenerationRun(run)
+		if err != nil {
+			return err
+		}
+	}
+
+	if st := c.IfileGeneration.Syncthing; st != nil {
+		u, err := url.Parse(st.APIURL)
+		if err != nil {
+			return fmt.Errorf("syncthing: invalid `api_url`: %v", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("syncthing: `api_url` must be an http or https URL")
+		}
+		if len(st.Folders) == 0 {
+			return fmt.Errorf("syncthing: empty `folders`. list folder IDs, or set it to `all`")
+		}
+		if st.RefreshInterval < 0 {
+			return fmt.Errorf("syncthing: negative `refresh_interval`")
+		}
+		if st.Run.Ifile != "" {
+			return fmt.Errorf("syncthing: `ifile` is the .stignore of each folder. remove it from config")
+		}
+		switch st.Run.Mode {
+		case "", "syncthing", "syncthing-patterns":
+		default:
+			return fmt.Errorf("syncthing: invalid `mode` field: %s. valid modes are: syncthing and syncthing-patterns", st.Run.Mode)
+		}
+		err = checkIfileGenerationRun(&st.Run, "syncthing folders")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckIfileGenerationRun checks a run of `ifile_generation`, or an ad-hoc watch
+// job that is added at runtime.
+func CheckIfileGenerationRun(run *IfileGenerationRun) error {
+	if run.Ifile == "" {
+		return fmt.Errorf("empty ifile path. remove it or set it to a file in config file")
+	}
+	if !filepath.IsAbs(run.Ifile) {
+		return fmt.Errorf("ifile path `%s` is not absolute. to avoid confusion, it must be absolute", run.Ifile)
+	}
+	return checkIfileGenerationRun(run, "ifile "+run.Ifile)
+}
+
+// Check the settings of an ifile generation run. desc is used in the errors.
+func checkIfileGenerationRun(run *IfileGenerationRun, desc string) error {
+	switch run.Restart.Policy {
+	case "", RestartPolicyNever, RestartPolicyOnFailure:
+	default:
+		return fmt.Errorf("invalid restart policy `%s` for %s. valid policies are: %s and %s", run.Restart.Policy, desc, RestartPolicyNever, RestartPolicyOnFailure)
+	}
+	if run.Restart.MaxAttempts < 0 {
+		return fmt.Errorf("negative `max_attempts` for %s", desc)
+	}
+	if run.Debounce < 0 || run.MaxDelay < 0 {
+		return fmt.Errorf("negative `debounce` or `max_delay` for %s", desc)
+	}
+	switch run.Watcher {
+	case "", WatcherFsnotify, WatcherPoll:
+	default:
+		return fmt.Errorf("invalid watcher `%s` for %s. valid watchers are: %s and %s", run.Watcher, desc, WatcherFsnotify, WatcherPoll)
+	}
+	if run.PollInterval < 0 {
+		return fmt.Errorf("negative `poll_interval` for %s", desc)
+	}
+	if run.ResyncInterval < 0 {
+		return fmt.Errorf("negative `resync_interval` for %s", desc)
+	}
+	if run.WalkWorkers < 0 {
+		return fmt.Errorf("negative `walk_workers` for %s", desc)
+	}
+	err := checkFileNames(run.IgnoreFiles, "ignore_files")
+	if err == nil {
+		err = checkFileNames(run.Markers, "markers")
+	}
+	if err != nil {
+		return fmt.Errorf("%v for %s", err, desc)
+	}
+	if run.Filters != nil {
+		err = run.Filters.check()
+		if err != nil {
+			return fmt.Errorf("%v for %s", err, desc)
+		}
+	}
+	return nil
+}
+
+// Ignore files and marker files are looked up in each directory, so they must be
+// file names, not paths. field is used in the errors.
+func checkFileNames(names []string, field string) error {
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("empty name in `%s`", field)
 		}
-		if !filepath.IsAbs(run.Ifile) {
-			return fmt.Errorf("ifile path `%s` is not absolute. to avoid confusion, it must be absolute", run.Ifile)
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return fmt.Errorf("invalid name `%s` in `%s`. it must be a file name, not a path", name, field)
 		}
 	}
 	return nil
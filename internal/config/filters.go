@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/karagenc/kopyat/internal/ifile"
+	"github.com/karagenc/kopyat/internal/utils"
+)
+
+type (
+	// Filters exclude files by their size, age and type.
+	Filters struct {
+		MaxSize   ByteSize `mapstructure:"max_size"`
+		MinSize   ByteSize `mapstructure:"min_size"`
+		OlderThan Age      `mapstructure:"older_than"`
+		NewerThan Age      `mapstructure:"newer_than"`
+		// Any of `socket`, `fifo` and `device`.
+		ExcludeTypes []string `mapstructure:"exclude_types"`
+	}
+
+	// Size in bytes, written like `2GB` or `500 MiB` in config.
+	ByteSize int64
+	// Duration, which can also be written in days, weeks and years, like `30d` in config.
+	Age time.Duration
+)
+
+const (
+	FileTypeSocket = "socket"
+	FileTypeFifo   = "fifo"
+	FileTypeDevice = "device"
+)
+
+// Whether files of type t are excluded.
+func (f *Filters) ExcludesType(t string) bool {
+	for _, e := range f.ExcludeTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// IfileFilters returns the filters of the ifile. It returns nil if f is nil, which
+// means no filters.
+func (f *Filters) IfileFilters() *ifile.Filters {
+	if f == nil {
+		return nil
+	}
+	return &ifile.Filters{
+		MaxSize:   int64(f.MaxSize),
+		MinSize:   int64(f.MinSize),
+		OlderThan: time.Duration(f.OlderThan),
+		NewerThan: time.Duration(f.NewerThan),
+		Sockets:   f.ExcludesType(FileTypeSocket),
+		Fifos:     f.ExcludesType(FileTypeFifo),
+		Devices:   f.ExcludesType(FileTypeDevice),
+	}
+}
+
+func (f *Filters) check() error {
+	if f.MinSize < 0 || f.MaxSize < 0 {
+		return fmt.Errorf("negative `min_size` or `max_size` in `filters`")
+	}
+	if f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		return fmt.Errorf("`min_size` is larger than `max_size` in `filters`")
+	}
+	if f.OlderThan < 0 || f.NewerThan < 0 {
+		return fmt.Errorf("negative `older_than` or `newer_than` in `filters`")
+	}
+	if f.OlderThan > 0 && f.NewerThan >= f.OlderThan {
+		return fmt.Errorf("`newer_than` is not less than `older_than` in `filters`, so every file would be excluded")
+	}
+	for _, t := range f.ExcludeTypes {
+		switch t {
+		case FileTypeSocket, FileTypeFifo, FileTypeDevice:
+		default:
+			return fmt.Errorf("invalid type `%s` in `exclude_types` of `filters`. valid types are: %s, %s and %s", t, FileTypeSocket, FileTypeFifo, FileTypeDevice)
+		}
+	}
+	return nil
+}
+
+// Decode strings (and numbers, for ByteSize) to ByteSize and Age.
+func filtersDecodeHook() mapstructure.DecodeHookFuncType {
+	return func(from, to reflect.Type, data interface{}) (interface{}, error) {
+		if from.Kind() != reflect.String {
+			return data, nil
+		}
+		switch to {
+		case reflect.TypeOf(ByteSize(0)):
+			n, err := utils.ParseBytes(data.(string))
+			return ByteSize(n), err
+		case reflect.TypeOf(Age(0)):
+			d, err := utils.ParseAge(data.(string))
+			return Age(d), err
+		}
+		return data, nil
+	}
+}
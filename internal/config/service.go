@@ -4,6 +4,8 @@ type (
 	Service struct {
 		Log string `mapstructure:"log"`
 		API API    `mapstructure:"api"`
+		// What to do when a watch job fails and is not going to be restarted.
+		OnWatchJobFailure string `mapstructure:"on_watch_job_failure"`
 	}
 
 	API struct {
@@ -20,3 +22,8 @@ type (
 		Password string `mapstructure:"password"`
 	}
 )
+
+const (
+	WatchJobFailureStopService = "stop_service"
+	WatchJobFailureMarkFailed  = "mark_failed"
+)
@@ -0,0 +1,4 @@
+package dashboard
+
+// This works like .gitkeep
+// Use make generate to generate statik.go
@@ -0,0 +1,67 @@
+package ifile
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Whether the entry at path is walked as a directory: it is one, or it is a symlink
+// to one and symlinks are followed. typ is the type of the entry itself.
+//
+// Symlinks are not followed if they point to one of their parent directories, which
+// would make the walk endless. Broken symlinks are listed as they are.
+func (l *ignoreLoader) isDir(path string, typ fs.FileMode) bool {
+	if typ.IsDir() {
+		return true
+	} else if !l.followSymlinks || typ&fs.ModeSymlink == 0 {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	return !isSymlinkLoop(path, info)
+}
+
+// Whether the directory that the symlink at path points to (info) is one of the
+// parent directories of path. Parents are compared by their targets too, so loops
+// through multiple symlinks (a/link -> b, b/link -> a) are found as well.
+func isSymlinkLoop(path string, info fs.FileInfo) bool {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if dirInfo, err := os.Stat(dir); err == nil && os.SameFile(dirInfo, info) {
+			return true
+		}
+		if filepath.Dir(dir) == dir {
+			return false
+		}
+	}
+}
+
+// Read the device of the root directory, if the walk shouldn't cross file systems.
+func (t *Tree) readDevice() error {
+	t.devOK = false
+	if !t.ignores.oneFileSystem {
+		return nil
+	}
+	info, err := os.Stat(t.root)
+	if err != nil {
+		return err
+	}
+	t.dev, t.devOK = device(info)
+	return nil
+}
+
+// Whether the directory at path is on another file system than the root
+// directory, and the walk shouldn't cross file systems.
+func (t *Tree) isMountPoint(path string) bool {
+	if !t.devOK {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	dev, ok := device(info)
+	return ok && dev != t.dev
+}
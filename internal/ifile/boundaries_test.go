@@ -0,0 +1,111 @@
+package ifile
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkFollowSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires privileges on Windows")
+	}
+	outside := t.TempDir()
+	mustWriteFile(t, filepath.Join(outside, "file"), "")
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, "a", "file"), "")
+	mustWriteFile(t, filepath.Join(root, "b", "file"), "")
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "*.log\n")
+	mustWriteFile(t, filepath.Join(outside, "debug.log"), "")
+	for link, target := range map[string]string{
+		"outside":  outside,
+		"parent":   root,
+		"a/link":   filepath.Join(root, "b"),
+		"b/link":   filepath.Join(root, "a"),
+		"a/self":   ".",
+		"a/broken": filepath.Join(root, "missing"),
+	} {
+		err := os.Symlink(target, filepath.Join(root, link))
+		require.NoError(t, err)
+	}
+
+	for _, workers := range []int{1, 4} {
+		lines := walkToLines(t, root, ModeRestic, &Options{Workers: workers})
+		require.Contains(t, lines, filepath.Join(root, "outside"))
+		require.NotContains(t, lines, filepath.Join(root, "outside", "file"))
+
+		lines = walkToLines(t, root, ModeRestic, &Options{Workers: workers, FollowSymlinks: true})
+		require.Contains(t, lines, filepath.Join(root, "outside", "file"), "workers: %d", workers)
+		require.NotContains(t, lines, filepath.Join(root, "outside", "debug.log"), "workers: %d", workers)
+		require.Contains(t, lines, filepath.Join(root, "a", "link", "file"), "workers: %d", workers)
+		// Symlinks to parent directories are listed, but not followed.
+		require.Contains(t, lines, filepath.Join(root, "parent"), "workers: %d", workers)
+		require.Contains(t, lines, filepath.Join(root, "a", "self"), "workers: %d", workers)
+		require.Contains(t, lines, filepath.Join(root, "a", "link", "link"), "workers: %d", workers)
+		require.NotContains(t, lines, filepath.Join(root, "a", "link", "link", "file"), "workers: %d", workers)
+		require.Contains(t, lines, filepath.Join(root, "a", "broken"), "workers: %d", workers)
+		for _, line := range lines {
+			require.NotContains(t, line, filepath.Join(root, "parent", "a"), "workers: %d", workers)
+		}
+	}
+}
+
+func TestWalkOneFileSystem(t *testing.T) {
+	// Another file system is reached through a symlink, as mounting requires privileges.
+	const other = "/dev/shm"
+	root := t.TempDir()
+	rootInfo, err := os.Stat(root)
+	require.NoError(t, err)
+	otherInfo, err := os.Stat(other)
+	if err != nil {
+		t.Skipf("%s doesn't exist", other)
+	}
+	rootDev, ok := device(rootInfo)
+	otherDev, _ := device(otherInfo)
+	if !ok || rootDev == otherDev {
+		t.Skipf("%s is not on another file system", other)
+	}
+	mustWriteFile(t, filepath.Join(root, "file"), "")
+	err = os.Symlink(other, filepath.Join(root, "shm"))
+	require.NoError(t, err)
+
+	opts := &Options{FollowSymlinks: true, OneFileSystem: true}
+	lines := walkToLines(t, root, ModeRestic, opts)
+	require.Contains(t, lines, filepath.Join(root, "file"))
+	for _, line := range lines {
+		require.NotContains(t, line, filepath.Join(root, "shm"))
+	}
+	lines = walkToLines(t, root, ModeResticExclude, opts)
+	require.Contains(t, lines, filepath.Join(root, "shm"))
+	lines = walkToLines(t, root, ModeSyncthingPatterns, opts)
+	require.Contains(t, lines, "/shm")
+
+	tree := NewTree(root, ModeRestic, opts)
+	err = tree.Build()
+	require.NoError(t, err)
+	totals, err := tree.Totals()
+	require.NoError(t, err)
+	require.Equal(t, Totals{FilesIncluded: 1}, totals)
+}
+
+func TestWalkSkipSpecialFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not reported as sockets on Windows")
+	}
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, "file"), "")
+	l, err := net.Listen("unix", filepath.Join(root, "socket"))
+	require.NoError(t, err)
+	defer l.Close()
+
+	lines := walkToLines(t, root, ModeRestic, &Options{SkipSpecialFiles: true})
+	require.Contains(t, lines, filepath.Join(root, "file"))
+	require.NotContains(t, lines, filepath.Join(root, "socket"))
+	// Other filters are kept.
+	lines = walkToLines(t, root, ModeRestic, &Options{SkipSpecialFiles: true, Filters: &Filters{MinSize: 1}})
+	require.NotContains(t, lines, filepath.Join(root, "file"))
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package ifile
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Return the ID of the device (file system) the file is on.
+func device(info fs.FileInfo) (dev uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
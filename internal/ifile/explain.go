@@ -0,0 +1,166 @@
+package ifile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pathspec "github.com/karagenc/go-pathspec"
+)
+
+type (
+	// Explanation tells why a path is excluded from the ifile or not.
+	Explanation struct {
+		Path     string
+		IsDir    bool
+		Excluded bool
+		// The excluded directory the path is inside of, if it is not walked.
+		// Matches are of this directory then.
+		ExcludedDir string
+		// Patterns that match the path, the highest precedence first.
+		Matches []PatternMatch
+		// Why the filters exclude the file, if they do.
+		Filter string
+		// Path of the marker file that excludes the path (or ExcludedDir), if there is one.
+		Marker string
+	}
+
+	PatternMatch struct {
+		// Path of the ignore file.
+		File    string
+		Line    int
+		Pattern string
+		// Whether the ignore file is a .kopyatinclude.
+		Include bool
+		// Whether this pattern decided whether the path is excluded.
+		Decisive bool
+	}
+)
+
+// Explain tells whether path would be excluded while walking root, and which
+// patterns match it. It follows the same rules as Walk.
+func Explain(root, path string, opts *Options) (*Explanation, error) {
+	root = filepath.Clean(root)
+	path = filepath.Clean(path)
+	if path != root && !isInDir(path, root) {
+		return nil, fmt.Errorf("%s is not inside %s", path, root)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &Explanation{
+		Path:  path,
+		IsDir: info.IsDir(),
+	}
+	if path == root {
+		return e, nil
+	}
+
+	var (
+		ignores     = newIgnoreLoader(opts)
+		ignorefiles []*ignorefile
+		dir         = root
+		dirExcluded = false
+	)
+	err = ignores.addIgnoreIfExists(&ignorefiles, root)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.TrimPrefix(path[len(root):], string(os.PathSeparator)), string(os.PathSeparator))
+	// The last part is the path itself.
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		dirExcluded = excluded(ignorefiles, dir, true, dirExcluded)
+		marker := ""
+		if !dirExcluded || couldInclude(ignorefiles, dir) {
+			marker, err = ignores.marker(dir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if marker != "" || (dirExcluded && !couldInclude(ignorefiles, dir)) {
+			e.Excluded = true
+			e.ExcludedDir = dir
+			e.Marker = marker
+			e.Matches, err = matches(ignorefiles, dir, true)
+			return e, err
+		}
+		err = ignores.addIgnoreIfExists(&ignorefiles, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.Excluded = excluded(ignorefiles, path, e.IsDir, dirExcluded)
+	if e.IsDir && (!e.Excluded || couldInclude(ignorefiles, path)) {
+		e.Marker, err = ignores.marker(path)
+		if err != nil {
+			return nil, err
+		}
+		e.Excluded = e.Excluded || e.Marker != ""
+	} else if !e.IsDir {
+		e.Filter = ignores.filters.match(info)
+		e.Excluded = e.Excluded || e.Filter != ""
+	}
+	e.Matches, err = matches(ignorefiles, path, e.IsDir)
+	return e, err
+}
+
+// Return the patterns that match path, the highest precedence first. As in excluded,
+// the closest ignore file with a matching pattern decides. In an ignore file,
+// the last matching pattern decides.
+func matches(ignorefiles []*ignorefile, path string, isDir bool) (matches []PatternMatch, err error) {
+	decided := false
+	for j := len(ignorefiles) - 1; j >= 0; j-- {
+		igFile := ignorefiles[j]
+		if !isInDir(path, igFile.dir) {
+			continue
+		}
+		trimmed := path[len(igFile.dir):]
+		if isDir && !strings.HasSuffix(trimmed, "/") {
+			trimmed += "/"
+		}
+		fileMatches, err := igFile.matches(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		if !decided && igFile.p.Match(trimmed) && len(fileMatches) > 0 {
+			decided = true
+			fileMatches[0].Decisive = true
+		}
+		matches = append(matches, fileMatches...)
+	}
+	return matches, nil
+}
+
+// Read the ignore file again to find the lines of the patterns that match path.
+// The last line comes first.
+func (f *ignorefile) matches(path string) (matches []PatternMatch, err error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		p, err := pathspec.FromLines(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		for _, pattern := range p.Patterns {
+			if pattern.Match(path) {
+				matches = append([]PatternMatch{{
+					File:    f.path,
+					Line:    line,
+					Pattern: pattern.Pattern(),
+					Include: f.include,
+				}}, matches...)
+			}
+		}
+	}
+	return matches, scanner.Err()
+}
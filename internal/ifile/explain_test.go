@@ -0,0 +1,96 @@
+package ifile
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	root := createTree(t, includeTree)
+	mustWriteFile(t, filepath.Join(root, "local2.db"), "")
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), ".env\n*.db\nsecrets/\nbuild/\nnode_modules/\n!local2.db\n")
+
+	tests := []struct {
+		path        string
+		excluded    bool
+		excludedDir string
+		matches     []PatternMatch
+	}{
+		{
+			path:     "local.db",
+			excluded: true,
+			matches: []PatternMatch{
+				{File: ".gitignore", Line: 2, Pattern: "*.db", Decisive: true},
+			},
+		},
+		{
+			path: "local2.db",
+			matches: []PatternMatch{
+				{File: ".gitignore", Line: 6, Pattern: "!local2.db"},
+				{File: ".gitignore", Line: 2, Pattern: "*.db"},
+			},
+		},
+		{
+			path: "build/keep",
+			matches: []PatternMatch{
+				{File: ".kopyatinclude", Line: 3, Pattern: "build/keep", Include: true, Decisive: true},
+				{File: ".gitignore", Line: 4, Pattern: "build/"},
+			},
+		},
+		{
+			path:     "sub/other.log",
+			excluded: true,
+			matches: []PatternMatch{
+				{File: "sub/.gitignore", Line: 1, Pattern: "*.log", Decisive: true},
+			},
+		},
+		{
+			// The closer .gitignore decides.
+			path:     "nested/.env",
+			excluded: true,
+			matches: []PatternMatch{
+				{File: "nested/.gitignore", Line: 1, Pattern: ".env", Decisive: true},
+				{File: ".kopyatinclude", Line: 1, Pattern: ".env", Include: true},
+				{File: ".gitignore", Line: 1, Pattern: ".env"},
+			},
+		},
+		{
+			path: "secrets",
+			matches: []PatternMatch{
+				{File: ".kopyatinclude", Line: 2, Pattern: "secrets/", Include: true, Decisive: true},
+				{File: ".gitignore", Line: 3, Pattern: "secrets/"},
+			},
+		},
+		{
+			path: "sub",
+		},
+	}
+	for _, test := range tests {
+		e, err := Explain(root, filepath.Join(root, test.path), nil)
+		require.NoError(t, err)
+		require.Equal(t, test.excluded, e.Excluded, test.path)
+		require.Equal(t, test.excludedDir, e.ExcludedDir, test.path)
+		for i := range test.matches {
+			test.matches[i].File = filepath.Join(root, test.matches[i].File)
+		}
+		require.Equal(t, test.matches, e.Matches, test.path)
+	}
+
+	// Ignore files inside an excluded directory are not read.
+	mustWriteFile(t, filepath.Join(root, "cache", "sub", ".kopyatinclude"), "file\n")
+	mustWriteFile(t, filepath.Join(root, "cache", "sub", "file"), "")
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "cache/\n")
+	mustWriteFile(t, filepath.Join(root, ".kopyatinclude"), "")
+	e, err := Explain(root, filepath.Join(root, "cache", "sub", "file"), nil)
+	require.NoError(t, err)
+	require.True(t, e.Excluded)
+	require.Equal(t, filepath.Join(root, "cache"), e.ExcludedDir)
+	require.Equal(t, []PatternMatch{
+		{File: filepath.Join(root, ".gitignore"), Line: 1, Pattern: "cache/", Decisive: true},
+	}, e.Matches)
+
+	_, err = Explain(root, t.TempDir(), nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,98 @@
+package ifile
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/karagenc/kopyat/internal/utils"
+)
+
+// Filters exclude files by their size, age and type, in addition to the ignore
+// files. They don't apply to directories. Zero values disable them.
+//
+// Files excluded by the filters are excluded even if a .kopyatinclude includes them.
+type Filters struct {
+	// Exclude regular files larger than MaxSize or smaller than MinSize bytes.
+	MaxSize int64
+	MinSize int64
+	// Exclude regular files modified longer than OlderThan ago, or more recently than NewerThan.
+	OlderThan time.Duration
+	NewerThan time.Duration
+	// Exclude sockets, named pipes (FIFOs) and device files.
+	Sockets bool
+	Fifos   bool
+	Devices bool
+}
+
+// Whether the files are filtered by their size.
+func (f *Filters) bySize() bool {
+	return f != nil && (f.MaxSize > 0 || f.MinSize > 0)
+}
+
+// Whether the files are filtered by their modification time.
+func (f *Filters) byAge() bool {
+	return f != nil && (f.OlderThan > 0 || f.NewerThan > 0)
+}
+
+// Return why the file is excluded by the filters, or an empty string if it is not.
+func (f *Filters) match(info fs.FileInfo) string {
+	if f == nil {
+		return ""
+	}
+	mode := info.Mode()
+	switch {
+	case mode&fs.ModeSocket != 0:
+		if f.Sockets {
+			return "it is a socket"
+		}
+		return ""
+	case mode&fs.ModeNamedPipe != 0:
+		if f.Fifos {
+			return "it is a named pipe (FIFO)"
+		}
+		return ""
+	case mode&fs.ModeDevice != 0:
+		if f.Devices {
+			return "it is a device file"
+		}
+		return ""
+	case !mode.IsRegular():
+		return ""
+	}
+
+	size := info.Size()
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return fmt.Sprintf("its size (%s) is larger than max_size (%s)", utils.FormatBytes(size), utils.FormatBytes(f.MaxSize))
+	}
+	if f.MinSize > 0 && size < f.MinSize {
+		return fmt.Sprintf("its size (%s) is smaller than min_size (%s)", utils.FormatBytes(size), utils.FormatBytes(f.MinSize))
+	}
+	age := time.Since(info.ModTime())
+	if f.OlderThan > 0 && age > f.OlderThan {
+		return fmt.Sprintf("it was modified %s ago, longer than older_than (%s)", age.Round(time.Second), f.OlderThan)
+	}
+	if f.NewerThan > 0 && age < f.NewerThan {
+		return fmt.Sprintf("it was modified %s ago, more recently than newer_than (%s)", age.Round(time.Second), f.NewerThan)
+	}
+	return ""
+}
+
+// Whether the file (not directory) at path is excluded by the filters. info is
+// read if it is nil. Files that don't exist anymore are not excluded.
+func (l *ignoreLoader) filtered(path string, info fs.FileInfo) (bool, error) {
+	if l.filters == nil {
+		return false, nil
+	}
+	if info == nil {
+		var err error
+		info, err = os.Lstat(path)
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return l.filters.match(info) != "", nil
+}
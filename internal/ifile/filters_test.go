@@ -0,0 +1,175 @@
+package ifile
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var filtersTree = testTree{
+	files: map[string]string{
+		".gitignore":  "*.log\n",
+		"small":       "1",
+		"large":       strings.Repeat("1", 2048),
+		"sub/main.go": "package main",
+		"sub/old":     "package main",
+	},
+	old: []string{"sub/old"},
+}
+
+func checkWalkFilters(t *testing.T, root string, workers int) {
+	filters := &Filters{MaxSize: 1024, OlderThan: 30 * 24 * time.Hour}
+	expected := map[Mode]string{
+		ModeSyncthing: "/large\n/sub/old\n",
+		ModeRestic:    filepath.Join(root, ".gitignore") + "\n" + filepath.Join(root, "small") + "\n" + filepath.Join(root, "sub", "main.go") + "\n",
+	}
+	for mode, lines := range expected {
+		got := walkToLines(t, root, mode, &Options{Workers: workers, Filters: filters})
+		require.Equal(t, generatedBy+"\n"+beginIndicator+"\n"+filepath.ToSlash(lines)+endIndicator+"\n", strings.Join(got, "\n"), "mode: %s", mode)
+	}
+}
+
+func TestTreeUpdateFilters(t *testing.T) {
+	root := createTree(t, filtersTree)
+	opts := &Options{Filters: &Filters{MinSize: 2, NewerThan: time.Hour}}
+	tree := NewTree(root, ModeSyncthing, opts)
+	err := tree.Build()
+	require.NoError(t, err)
+
+	tests := []struct {
+		change   func()
+		path     string
+		filtered bool
+	}{
+		{
+			change:   func() {},
+			path:     filepath.Join(root, "small"),
+			filtered: true,
+		},
+		{
+			change: func() {
+				mustWriteFile(t, filepath.Join(root, "small"), "large enough")
+				old := time.Now().Add(-2 * time.Hour)
+				err := os.Chtimes(filepath.Join(root, "small"), old, old)
+				require.NoError(t, err)
+			},
+			path: filepath.Join(root, "small"),
+		},
+		{
+			change:   func() { mustWriteFile(t, filepath.Join(root, "sub", "main.go"), "") },
+			path:     filepath.Join(root, "sub", "main.go"),
+			filtered: true,
+		},
+	}
+	for _, test := range tests {
+		test.change()
+		err = tree.Update(test.path)
+		require.NoError(t, err)
+		filtered := false
+		for _, path := range tree.filteredPaths() {
+			if path == test.path {
+				filtered = true
+			}
+		}
+		require.Equal(t, test.filtered, filtered, test.path)
+	}
+}
+
+func TestWalkFiltersFileTypes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not reported as sockets on Windows")
+	}
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, "file"), "")
+	l, err := net.Listen("unix", filepath.Join(root, "socket"))
+	require.NoError(t, err)
+	defer l.Close()
+
+	for _, filters := range []*Filters{nil, {Sockets: true}} {
+		testIfile := filepath.Join(t.TempDir(), "ifile")
+		i, err := NewWithOptions(testIfile, ModeSyncthing, false, &Options{Filters: filters}, zap.NewNop())
+		require.NoError(t, err)
+		err = i.Walk(root)
+		require.NoError(t, err)
+		err = i.Close()
+		require.NoError(t, err)
+		content, err := os.ReadFile(testIfile)
+		require.NoError(t, err)
+		require.Equal(t, filters != nil, strings.Contains(string(content), "\n/socket\n"))
+		require.NotContains(t, string(content), "\n/file\n")
+	}
+}
+
+func TestWalkFiltersSyncthingPatterns(t *testing.T) {
+	root := createTree(t, filtersTree)
+	testIfile := filepath.Join(t.TempDir(), "ifile")
+	opts := &Options{Filters: &Filters{MaxSize: 1024}, Deletable: true}
+	i, err := NewWithOptions(testIfile, ModeSyncthingPatterns, false, opts, zap.NewNop())
+	require.NoError(t, err)
+	err = i.Walk(root)
+	require.NoError(t, err)
+	err = i.Close()
+	require.NoError(t, err)
+	content, err := os.ReadFile(testIfile)
+	require.NoError(t, err)
+
+	// Filtered files are listed first, as they can't be expressed as patterns.
+	require.Equal(t, []string{
+		generatedBy,
+		beginIndicator,
+		"// filters",
+		"(?d)/large",
+		"// .gitignore",
+		"(?d)*.log",
+		endIndicator,
+		"",
+	}, strings.Split(string(content), "\n"))
+}
+
+func TestExplainFilters(t *testing.T) {
+	root := createTree(t, filtersTree)
+	opts := &Options{Filters: &Filters{MaxSize: 1024}}
+
+	e, err := Explain(root, filepath.Join(root, "large"), opts)
+	require.NoError(t, err)
+	require.True(t, e.Excluded)
+	require.Contains(t, e.Filter, "max_size")
+
+	e, err = Explain(root, filepath.Join(root, "small"), opts)
+	require.NoError(t, err)
+	require.False(t, e.Excluded)
+	require.Empty(t, e.Filter)
+}
+
+// Make sure the age filters decide again when a file is written to, and when
+// a file crosses them as time passes, without any event.
+func TestWatchAgeFilters(t *testing.T) {
+	j := newTempWatchJob(t, &WatchJobOptions{Ifile: Options{Filters: &Filters{NewerThan: time.Hour}}}, func(scanPath string) {
+		mustWriteFile(t, filepath.Join(scanPath, "old"), "")
+		old := time.Now().Add(-2 * time.Hour)
+		err := os.Chtimes(filepath.Join(scanPath, "old"), old, old)
+		require.NoError(t, err)
+	})
+	j.start(t)
+	require.False(t, j.hasLine("/old"))
+	err := os.WriteFile(filepath.Join(j.scanPath, "old"), []byte("1"), 0644)
+	require.NoError(t, err)
+	waitFor(t, func() bool { return j.hasLine("/old") })
+
+	j = newTempWatchJob(t, &WatchJobOptions{
+		ResyncInterval: 100 * time.Millisecond,
+		Ifile:          Options{Filters: &Filters{NewerThan: time.Second}},
+	}, func(scanPath string) {
+		mustWriteFile(t, filepath.Join(scanPath, "new"), "")
+	})
+	j.start(t)
+	require.True(t, j.hasLine("/new"))
+	waitFor(t, func() bool { return !j.hasLine("/new") })
+}
@@ -0,0 +1,198 @@
+package ifile
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	pathspec "github.com/karagenc/go-pathspec"
+)
+
+// Return the path of the git excludes file of the repository whose root is repo.
+// It is core.excludesFile if it is set in the repository's config or the global
+// one, $XDG_CONFIG_HOME/git/ignore or ~/.config/git/ignore otherwise.
+func gitExcludesFile(repo string) string {
+	out, err := exec.Command("git", "-C", repo, "config", "--path", "--get", "core.excludesFile").Output()
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		// Exit code 1 means it is not set. Otherwise git couldn't read the
+		// config of the repository, e.g. because it is owned by another user.
+		out, err = exec.Command("git", "config", "--global", "--path", "--get", "core.excludesFile").Output()
+	}
+	if err == nil {
+		if path := string(bytes.TrimSpace(out)); path != "" {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(repo, path)
+			}
+			return path
+		}
+	}
+	if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); xdgConfigHome != "" {
+		return filepath.Join(xdgConfigHome, "git", "ignore")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "git", "ignore")
+}
+
+// A git excludes file, read once for all repositories that use it.
+type gitExcludes struct {
+	p   *pathspec.PathSpec
+	err error
+}
+
+// If dir is the root directory of a git repository, add its git excludes file
+// and .git/info/exclude. Like git does, their patterns are relative to dir.
+func (l *ignoreLoader) addGitExcludes(ignorefiles *[]*ignorefile, dir string) error {
+	gitDir, ok := findGitDir(dir)
+	if !ok {
+		return nil
+	}
+
+	excludesPath, excludes := l.excludesOf(dir)
+	if excludes.err != nil {
+		return excludes.err
+	}
+	if excludes.p != nil {
+		*ignorefiles = append(*ignorefiles, &ignorefile{
+			p:    excludes.p,
+			dir:  dir,
+			path: excludesPath,
+		})
+	}
+
+	// Worktrees share info/exclude of the main repository.
+	if content, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir := string(bytes.TrimSpace(content))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+		gitDir = commonDir
+	}
+	path := filepath.Join(gitDir, "info", "exclude")
+	if f, err := os.Stat(path); err == nil && f.Mode().Type().IsRegular() {
+		p, err := pathspec.FromFile(path)
+		if err != nil {
+			return err
+		}
+		*ignorefiles = append(*ignorefiles, &ignorefile{
+			p:    p,
+			dir:  dir,
+			path: path,
+		})
+	}
+	return nil
+}
+
+// Return the path of the git excludes file of the repository whose root is repo,
+// and the file. They are looked up once, when the repository is first found.
+func (l *ignoreLoader) excludesOf(repo string) (string, *gitExcludes) {
+	l.excludesMu.Lock()
+	defer l.excludesMu.Unlock()
+	path, ok := l.repoExcludes[repo]
+	if !ok {
+		path = l.excludesFile
+		if path == "" {
+			path = gitExcludesFile(repo)
+		}
+		l.repoExcludes[repo] = path
+	}
+	if path == "" {
+		return "", &gitExcludes{}
+	}
+	excludes, ok := l.excludes[path]
+	if !ok {
+		excludes = &gitExcludes{}
+		if f, err := os.Stat(path); err == nil && f.Mode().Type().IsRegular() {
+			excludes.p, excludes.err = pathspec.FromFile(path)
+		}
+		l.excludes[path] = excludes
+	}
+	return path, excludes
+}
+
+// Return the paths of the git excludes files of the repositories found so far,
+// or nil if git's excludes are not respected.
+func (l *ignoreLoader) excludesPaths() (paths []string) {
+	if !l.gitExcludes {
+		return nil
+	}
+	l.excludesMu.Lock()
+	defer l.excludesMu.Unlock()
+	for _, path := range l.repoExcludes {
+		if path != "" && !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+	return
+}
+
+// Files of a git directory that git's excludes are read from, relative to it.
+// config is where core.excludesFile of the repository can be set.
+var gitExcludesFiles = []string{"commondir", "config", "info", filepath.Join("info", "exclude")}
+
+// If path is a file that git's excludes are read from, forget what is read from
+// it, and return the directory whose ignore files it changes: the root of its
+// repository, or root for a git excludes file. A created or removed .git changes
+// the excludes of its directory too.
+func (l *ignoreLoader) invalidateGitExcludes(path, root string) (dir string, ok bool) {
+	if !l.gitExcludes {
+		return "", false
+	}
+	l.excludesMu.Lock()
+	defer l.excludesMu.Unlock()
+	for _, excludesPath := range l.repoExcludes {
+		if path == excludesPath {
+			delete(l.excludes, path)
+			return root, true
+		}
+	}
+	if filepath.Base(path) == ".git" {
+		dir = filepath.Dir(path)
+		delete(l.repoExcludes, dir)
+		return dir, true
+	}
+	for _, name := range gitExcludesFiles {
+		gitDir, ok := strings.CutSuffix(path, string(filepath.Separator)+name)
+		if ok && filepath.Base(gitDir) == ".git" {
+			dir = filepath.Dir(gitDir)
+			delete(l.repoExcludes, dir)
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// Return the git directory of the repository whose root is dir. .git is either the
+// git directory, or a file pointing to it (in submodules and worktrees).
+func findGitDir(dir string) (gitDir string, ok bool) {
+	gitDir = filepath.Join(dir, ".git")
+	f, err := os.Lstat(gitDir)
+	if err != nil {
+		return "", false
+	} else if f.IsDir() {
+		return gitDir, true
+	} else if !f.Mode().Type().IsRegular() {
+		return "", false
+	}
+
+	content, err := os.ReadFile(gitDir)
+	if err != nil {
+		return "", false
+	}
+	path, ok := strings.CutPrefix(string(bytes.TrimSpace(content)), "gitdir: ")
+	if !ok {
+		return "", false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return path, true
+}
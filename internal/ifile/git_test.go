@@ -0,0 +1,162 @@
+package ifile
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// Make sure git's excludes apply only inside repositories, relative to their root.
+func TestWalkGitExcludes(t *testing.T) {
+	root := t.TempDir()
+	globalExcludes := filepath.Join(t.TempDir(), "ignore")
+	mustWriteFile(t, globalExcludes, "*.log\n")
+
+	mustWriteFile(t, filepath.Join(root, "repo", ".git", "info", "exclude"), "/excluded\n")
+	mustWriteFile(t, filepath.Join(root, "repo", "excluded"), "")
+	mustWriteFile(t, filepath.Join(root, "repo", "sub", "excluded"), "")
+	mustWriteFile(t, filepath.Join(root, "repo", "sub", "a.log"), "")
+	// A submodule, whose git directory is inside the parent repository.
+	mustWriteFile(t, filepath.Join(root, "repo", ".git", "modules", "submodule", "info", "exclude"), "file\n")
+	mustWriteFile(t, filepath.Join(root, "repo", "submodule", ".git"), "gitdir: ../.git/modules/submodule\n")
+	mustWriteFile(t, filepath.Join(root, "repo", "submodule", "file"), "")
+	// Not a repository.
+	mustWriteFile(t, filepath.Join(root, "other", "excluded"), "")
+	mustWriteFile(t, filepath.Join(root, "other", "b.log"), "")
+
+	walk := func(opts *Options) []string {
+		testIfile := filepath.Join(t.TempDir(), "ifile")
+		i, err := NewWithOptions(testIfile, ModeRestic, false, opts, zap.NewNop())
+		require.NoError(t, err)
+		err = i.Walk(root)
+		require.NoError(t, err)
+		err = i.Close()
+		require.NoError(t, err)
+		content, err := os.ReadFile(testIfile)
+		require.NoError(t, err)
+		return strings.Split(string(content), "\n")
+	}
+	path := func(elem ...string) string {
+		return filepath.ToSlash(filepath.Join(append([]string{root}, elem...)...))
+	}
+
+	lines := walk(nil)
+	require.Contains(t, lines, path("repo", "excluded"))
+	require.Contains(t, lines, path("repo", "sub", "a.log"))
+	require.Contains(t, lines, path("repo", "submodule", "file"))
+
+	for _, workers := range []int{1, 4} {
+		lines = walk(&Options{GitExcludes: true, GitExcludesFile: globalExcludes, Workers: workers})
+		require.NotContains(t, lines, path("repo", "excluded"))
+		require.Contains(t, lines, path("repo", "sub", "excluded"))
+		require.NotContains(t, lines, path("repo", "sub", "a.log"))
+		require.NotContains(t, lines, path("repo", "submodule", "file"))
+		require.Contains(t, lines, path("other", "excluded"))
+		require.Contains(t, lines, path("other", "b.log"))
+	}
+}
+
+func TestWatchFilterGitExcludes(t *testing.T) {
+	root := t.TempDir()
+	globalExcludes := filepath.Join(t.TempDir(), "ignore")
+	mustWriteFile(t, filepath.Join(root, "repo", ".git", "info", "exclude"), "")
+
+	filter := newWatchFilter(root, "", nil)
+	require.True(t, filter.isNoise(filepath.Join(root, "repo", ".git", "info", "exclude")))
+	require.Empty(t, filter.exceptions(filepath.Join(root, "repo", ".git")))
+
+	filter = newWatchFilter(root, "", &Options{GitExcludes: true, GitExcludesFile: globalExcludes})
+	require.False(t, filter.isNoise(filepath.Join(root, "repo", ".git", "info", "exclude")))
+	require.False(t, filter.isNoise(filepath.Join(root, "repo", ".git", "commondir")))
+	require.False(t, filter.isNoise(filepath.Join(root, "repo", ".git", "config")))
+	require.True(t, filter.isNoise(filepath.Join(root, "repo", ".git", "index")))
+	require.True(t, filter.isNoise(filepath.Join(root, "repo", ".git", "objects", "info", "exclude")))
+	require.Equal(t, []string{
+		filepath.Join(root, "repo", ".git", "commondir"),
+		filepath.Join(root, "repo", ".git", "config"),
+		filepath.Join(root, "repo", ".git", "info"),
+	}, filter.exceptions(filepath.Join(root, "repo", ".git")))
+	require.Equal(t, []string{
+		filepath.Join(root, "repo", ".git", "info", "exclude"),
+	}, filter.exceptions(filepath.Join(root, "repo", ".git", "info")))
+	// Outside the watched directory, only the git excludes files are not noise.
+	require.False(t, filter.isNoise(globalExcludes))
+	require.True(t, filter.isNoise(filepath.Join(filepath.Dir(globalExcludes), "config")))
+}
+
+// Make sure changes of git's excludes regenerate the ifile.
+func TestWatchGitExcludes(t *testing.T) {
+	globalExcludes := filepath.Join(t.TempDir(), "ignore")
+	ifileOpts := Options{GitExcludes: true, GitExcludesFile: globalExcludes}
+
+	for _, opts := range []*WatchJobOptions{
+		{Ifile: ifileOpts},
+		{Ifile: ifileOpts, Incremental: true},
+		{Ifile: ifileOpts, Poll: true, PollInterval: 50 * time.Millisecond},
+	} {
+		mustWriteFile(t, globalExcludes, "")
+		j := newTempWatchJob(t, opts, func(scanPath string) {
+			mustWriteFile(t, filepath.Join(scanPath, "repo", ".git", "HEAD"), "")
+			mustWriteFile(t, filepath.Join(scanPath, "repo", "file"), "")
+			mustWriteFile(t, filepath.Join(scanPath, "repo", "a.log"), "")
+		})
+		j.start(t)
+		waitFor(t, func() bool { return j.walks() > 0 })
+		require.False(t, j.hasLine("/repo/file"))
+
+		mustWriteFile(t, filepath.Join(j.scanPath, "repo", ".git", "info", "exclude"), "/file\n")
+		waitFor(t, func() bool { return j.hasLine("/repo/file") })
+
+		mustWriteFile(t, globalExcludes, "*.log\n")
+		waitFor(t, func() bool { return j.hasLine("/repo/a.log") })
+	}
+}
+
+// Make sure core.excludesFile is read from the config of each repository.
+func TestGitExcludesFile(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	git := func(args ...string) {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	var (
+		root         = t.TempDir()
+		repo         = filepath.Join(root, "repo")
+		other        = filepath.Join(root, "other")
+		repoIgnore   = filepath.Join(t.TempDir(), "repo-ignore")
+		globalIgnore = filepath.Join(t.TempDir(), "global-ignore")
+	)
+	git("init", "-q", repo)
+	git("init", "-q", other)
+	require.Equal(t, filepath.Join(home, ".config", "git", "ignore"), gitExcludesFile(repo))
+
+	git("-C", repo, "config", "core.excludesFile", repoIgnore)
+	git("config", "--global", "core.excludesFile", globalIgnore)
+	require.Equal(t, repoIgnore, gitExcludesFile(repo))
+	require.Equal(t, globalIgnore, gitExcludesFile(other))
+
+	mustWriteFile(t, repoIgnore, "*.log\n")
+	mustWriteFile(t, globalIgnore, "*.tmp\n")
+	for _, dir := range []string{repo, other} {
+		mustWriteFile(t, filepath.Join(dir, "a.log"), "")
+		mustWriteFile(t, filepath.Join(dir, "a.tmp"), "")
+	}
+	lines := walkToLines(t, root, ModeRestic, &Options{GitExcludes: true})
+	require.NotContains(t, lines, filepath.ToSlash(filepath.Join(repo, "a.log")))
+	require.Contains(t, lines, filepath.ToSlash(filepath.Join(repo, "a.tmp")))
+	require.Contains(t, lines, filepath.ToSlash(filepath.Join(other, "a.log")))
+	require.NotContains(t, lines, filepath.ToSlash(filepath.Join(other, "a.tmp")))
+}
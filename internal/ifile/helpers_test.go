@@ -0,0 +1,108 @@
+package ifile
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testTree is a directory to create for a test.
+type testTree struct {
+	// Contents of the files, by their paths relative to the directory, separated by slashes.
+	files map[string]string
+	// Files whose modification time is set to 60 days ago.
+	old []string
+	// Directories that are made unreadable.
+	unreadable []string
+}
+
+func createTree(t *testing.T, tree testTree) string {
+	root := t.TempDir()
+	for path, content := range tree.files {
+		mustWriteFile(t, filepath.Join(root, filepath.FromSlash(path)), content)
+	}
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	for _, path := range tree.old {
+		err := os.Chtimes(filepath.Join(root, filepath.FromSlash(path)), old, old)
+		require.NoError(t, err)
+	}
+	for _, dir := range tree.unreadable {
+		mustMakeUnreadable(t, filepath.Join(root, filepath.FromSlash(dir)))
+	}
+	return root
+}
+
+func walkToLines(t *testing.T, root string, mode Mode, opts *Options) []string {
+	_, lines := walkToIfile(t, root, mode, opts)
+	return lines
+}
+
+// Like walkToLines, but also return the closed ifile, e.g. to check its unreadable directories.
+func walkToIfile(t *testing.T, root string, mode Mode, opts *Options) (*Ifile, []string) {
+	testIfile := filepath.Join(t.TempDir(), "ifile")
+	i, err := NewWithOptions(testIfile, mode, false, opts, zap.NewNop())
+	require.NoError(t, err)
+	err = i.Walk(root)
+	require.NoError(t, err)
+	err = i.Close()
+	require.NoError(t, err)
+	content, err := os.ReadFile(testIfile)
+	require.NoError(t, err)
+	return i, strings.Split(string(content), "\n")
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for retries := 0; !cond(); retries++ {
+		if retries >= 200 {
+			t.Fatal("waiting timed out")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func mustWriteFile(t *testing.T, path, content string) {
+	mustCreateDir(t, filepath.Dir(path))
+	err := os.WriteFile(path, []byte(content), 0644)
+	require.NoError(t, err)
+}
+
+func mustCreateDir(t *testing.T, path string) {
+	err := os.MkdirAll(path, 0755)
+	require.NoError(t, err)
+}
+
+// Directories that readDir can't read, as if they had no permissions. Unlike
+// permissions, this works for root and on Windows too.
+var unreadableDirs sync.Map
+
+func init() {
+	readDir = func(name string) ([]fs.DirEntry, error) {
+		if _, ok := unreadableDirs.Load(name); ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+		return os.ReadDir(name)
+	}
+}
+
+// Make dir unreadable until it is made readable with mustMakeReadable, or the end of the test.
+func mustMakeUnreadable(t *testing.T, dir string) {
+	unreadableDirs.Store(dir, true)
+	// Also remove its permissions, so that watchers see the changes of them.
+	err := os.Chmod(dir, 0)
+	require.NoError(t, err)
+	// Let TempDir remove it.
+	t.Cleanup(func() { mustMakeReadable(t, dir) })
+}
+
+func mustMakeReadable(t *testing.T, dir string) {
+	unreadableDirs.Delete(dir)
+	err := os.Chmod(dir, 0755)
+	require.NoError(t, err)
+}
@@ -1,15 +1,18 @@
 package ifile
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 
 	pathspec "github.com/karagenc/go-pathspec"
+	"github.com/karagenc/kopyat/internal/utils"
 	"go.uber.org/zap"
 )
 
@@ -24,20 +27,98 @@ type (
 		end   []byte
 
 		filePath         string
-		file             *os.File
 		appendToExisting bool
 		once             sync.Once
+		// Whether Close found the ifile on disk identical, and didn't write it.
+		unchanged bool
+
+		workers int
+		ignores *ignoreLoader
+		// Directories that couldn't be read by the walks. Guarded by bufMu.
+		unreadable []Unreadable
+		// Prefixes of the syncthing patterns. See Options.
+		caseInsensitive bool
+		deletable       bool
+
+		// The ifile is written to tmp, which is renamed to filePath on Close. If
+		// streaming, entries are written to tmp as they are walked, instead of
+		// being kept in buf.
+		stream bool
+		tmp    *os.File
+		w      *bufio.Writer
+	}
+
+	Options struct {
+		// Number of directories to walk concurrently. Output is the same
+		// regardless of it. 0 or 1 means directories are walked one by one.
+		Workers int
+		// Write entries to a temporary file as they are walked, instead of keeping
+		// them in memory. The file is renamed to the ifile on Close, so the ifile is
+		// never seen partially written.
+		Stream bool
+		// Names of the ignore files to read in each directory. Default is
+		// .gitignore and .kopyatignore.
+		IgnoreFiles []string
+		// Also read .git/info/exclude and the git excludes file (core.excludesFile)
+		// in the root directory of git repositories.
+		GitExcludes bool
+		// Path of the git excludes file to read in all repositories, instead of
+		// their core.excludesFile.
+		GitExcludesFile string
+		// Exclude files by their size, age and type too. nil means no filters.
+		Filters *Filters
+		// Walk into the directories that symlinks point to. Symlinks that point
+		// to one of their parent directories are not followed.
+		FollowSymlinks bool
+		// Don't walk into directories on other file systems (mount points) than
+		// the walked directory. They are excluded.
+		OneFileSystem bool
+		// Exclude sockets, named pipes (FIFOs) and device files, as if they were
+		// excluded by Filters.
+		SkipSpecialFiles bool
+		// Names of marker files. A directory that contains one of them is excluded
+		// with everything inside it, even if a .kopyatinclude includes entries inside
+		// it. CachedirTag counts only if it has the signature.
+		Markers []string
+		// Fail the walk if a directory can't be read because of its permissions,
+		// instead of skipping it. Skipped directories are reported by Unreadable.
+		FailOnUnreadable bool
+		// Only for ModeSyncthingPatterns. Prefix the patterns with `(?i)`, so that
+		// they match case-insensitively.
+		CaseInsensitive bool
+		// Only for ModeSyncthingPatterns. Prefix the exclude patterns with `(?d)`, so
+		// that syncthing can delete the excluded files if they prevent a directory
+		// from being deleted.
+		Deletable bool
 	}
 
 	entry struct {
 		path  string
 		isDir bool
+		// Only for ModeRsync. Whether the entry is written as an include (`+`) rule.
+		include bool
+		// Only for ModeRsync. Whether the rule matches the entries inside the
+		// directory, instead of the directory itself.
+		contents bool
+	}
+
+	// collector receives entries in the order they are walked (a directory first,
+	// then the entries inside it), and writes the ones that belong to the ifile.
+	// A directory is written only if it is empty, which is known once the next
+	// entry is received.
+	collector struct {
+		write func(e *entry) error
+		// Last received directory, if it is not known whether it is empty yet.
+		dir *entry
 	}
-	entries []*entry
 
 	ignorefile struct {
 		p   *pathspec.PathSpec
 		dir string
+		// Path of the file itself.
+		path string
+		// Whether it is a .kopyatinclude.
+		include bool
 	}
 
 	Mode int
@@ -48,6 +129,22 @@ const (
 	ModeRestic Mode = iota
 	// Ignore file. Paths are relative to the .gitignore/.kopyatignore.
 	ModeSyncthing
+	// rsync filter file, to be used with `--filter='merge <ifile>'`. Rules are
+	// anchored to the walked directory. Entries included by a .kopyatinclude inside
+	// an excluded directory get include rules before the rule that excludes the rest.
+	ModeRsync
+	// tar exclude file, to be used with `--anchored --exclude-from=<ifile>`
+	// while archiving `.` in the walked directory. It has no I_BEGIN and I_END
+	// indicators, as tar would read them as patterns.
+	ModeTar
+	// restic exclude file, to be used with `--exclude-file`. The patterns of the ignore
+	// files are translated to restic's syntax, anchored at the directory of each ignore
+	// file, so that they match the files created after the generation too. Entries
+	// excluded by the filters and marker files are written as absolute paths.
+	ModeResticExclude
+	// Ignore file. Instead of the paths, patterns of the ignore files are translated
+	// to syncthing's syntax, so that they match the files created after the generation too.
+	ModeSyncthingPatterns
 )
 
 func (m Mode) String() string {
@@ -56,11 +153,44 @@ func (m Mode) String() string {
 		return "restic"
 	case ModeSyncthing:
 		return "syncthing"
+	case ModeRsync:
+		return "rsync"
+	case ModeTar:
+		return "tar"
+	case ModeResticExclude:
+		return "restic-exclude"
+	case ModeSyncthingPatterns:
+		return "syncthing-patterns"
 	default:
 		return "<invalid mode>"
 	}
 }
 
+// Whether the ifile lists the excluded entries (relative to the walked directory),
+// instead of the included ones.
+func (m Mode) listsExcluded() bool { return m != ModeRestic }
+
+// Whether the ifile has the patterns of the ignore files, instead of the paths of the entries.
+func (m Mode) writesPatterns() bool { return m == ModeSyncthingPatterns || m == ModeResticExclude }
+
+// Whether the ifile has the I_BEGIN and I_END indicators. tar exclude files have no
+// comment syntax, so the whole file is generated, and the lines outside of the
+// indicators aren't kept.
+func (m Mode) hasIndicators() bool { return m != ModeTar }
+
+// Path of an excluded entry as it is written to the ifile. It is relative to root,
+// except in ModeResticExclude.
+func (m Mode) excludedPath(root, path string) string {
+	if m == ModeResticExclude {
+		return path
+	}
+	rel := path[len(root):]
+	if runningOnWindows {
+		rel = utils.StripDriveLetter(rel)
+	}
+	return rel
+}
+
 const (
 	generatedBy    = "# Generated by kopyat. DO NOT TOUCH THE LINES BETWEEN I_BEGIN AND I_END."
 	beginIndicator = "# I_BEGIN"
@@ -73,39 +203,99 @@ func New(
 	appendToExisting bool,
 	log *zap.Logger,
 ) (ifile *Ifile, err error) {
+	return NewWithOptions(filePath, mode, appendToExisting, nil, log)
+}
+
+func NewWithOptions(
+	filePath string,
+	mode Mode,
+	appendToExisting bool,
+	opts *Options,
+	log *zap.Logger,
+) (ifile *Ifile, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
 	ifile = &Ifile{
 		log:              log,
 		logS:             log.Sugar(),
 		mode:             mode,
 		filePath:         filePath,
 		appendToExisting: appendToExisting,
+		workers:          opts.Workers,
+		stream:           opts.Stream,
+		ignores:          newIgnoreLoader(opts),
+		caseInsensitive:  opts.CaseInsensitive,
+		deletable:        opts.Deletable,
 	}
 
-	flags := os.O_CREATE | os.O_RDWR
-	ifile.file, err = os.OpenFile(ifile.filePath, flags, 0660)
-	if err != nil {
-		return nil, err
+	// If the ifile is a symlink, replace its target instead of the symlink.
+	if target, err := filepath.EvalSymlinks(ifile.filePath); err == nil {
+		ifile.filePath = target
+	}
+
+	if !mode.hasIndicators() {
+		ifile.appendToExisting = false
 	}
 
+	var content []byte
 	if ifile.appendToExisting {
-		err = ifile.prepareExisting()
+		content, err = os.ReadFile(ifile.filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if ifile.stream {
+		err = ifile.createTemp()
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		ifile.buf.WriteString(generatedBy + "\n")
-		ifile.buf.WriteString(beginIndicator + "\n")
+	}
+
+	if ifile.appendToExisting {
+		err = ifile.prepareExisting(content)
+	} else if mode.hasIndicators() {
+		ifile.writer().WriteString(generatedBy + "\n")
+		ifile.writer().WriteString(beginIndicator + "\n")
 		ifile.end = append(ifile.end, []byte(endIndicator+"\n")...)
 	}
+	if err != nil {
+		ifile.discard()
+		return nil, err
+	}
 	return
 }
 
-func (i *Ifile) prepareExisting() error {
-	content, err := io.ReadAll(i.file)
+// Where the entries are written to. Should be called with bufMu locked, except in New.
+func (i *Ifile) writer() interface {
+	io.Writer
+	io.StringWriter
+} {
+	if i.stream {
+		return i.w
+	}
+	return &i.buf
+}
+
+// Create the temporary file next to the ifile, so that it can be renamed to it.
+func (i *Ifile) createTemp() (err error) {
+	i.tmp, err = os.CreateTemp(filepath.Dir(i.filePath), "."+filepath.Base(i.filePath)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	i.w = bufio.NewWriter(i.tmp)
+	return nil
+}
 
+// Remove the temporary file without writing the ifile.
+func (i *Ifile) discard() {
+	if i.tmp != nil {
+		i.tmp.Close()
+		os.Remove(i.tmp.Name())
+	}
+}
+
+func (i *Ifile) prepareExisting(content []byte) error {
 	content = bytes.ReplaceAll(content, []byte{'\r', '\n'}, []byte{'\n'})
 	splitted := bytes.Split(content, []byte{'\n'})
 
@@ -131,61 +321,150 @@ func (i *Ifile) prepareExisting() error {
 
 	i.logS.Debugf("ifile: %s: begin %d, end %d", i.filePath, begin, end)
 
+	w := i.writer()
 	if begin == -1 && end == -1 {
-		i.buf.Write(content)
-		i.buf.WriteString(generatedBy + "\n")
-		i.buf.WriteString(beginIndicator + "\n")
+		w.Write(content)
+		w.WriteString(generatedBy + "\n")
+		w.WriteString(beginIndicator + "\n")
 		i.end = append(i.end, []byte(endIndicator+"\n")...)
 	} else {
-		i.buf.Write(content[:begin+len(beginIndicator)])
-		i.buf.WriteString("\n")
+		w.Write(content[:begin+len(beginIndicator)])
+		w.WriteString("\n")
 		i.end = content[end:]
 	}
 	return nil
 }
 
+// Close writes the ifile. If the ifile on disk is identical, it is left
+// untouched, and Unchanged reports true.
 func (i *Ifile) Close() (err error) {
-	var (
-		err1 error
-		err2 error
-	)
 	i.once.Do(func() {
-		if i.appendToExisting {
-			_, err = i.file.Seek(0, io.SeekStart)
-			if err != nil {
-				return
-			}
-			err = i.file.Truncate(0)
-			if err != nil {
-				return
-			}
+		err = i.close()
+		if err != nil {
+			i.discard()
 		}
-		i.logS.Debugf("ifile: %s: writing i.buf", i.filePath)
-		_, err1 = i.file.Write(i.buf.Bytes())
-		if len(i.end) != 0 {
-			i.logS.Debugf("ifile: %s: writing i.end", i.filePath)
-			_, err2 = i.file.Write(i.end)
-		} else {
-			i.logS.Debugf("ifile: %s: writing newline", i.filePath)
-			_, err2 = i.file.WriteString("\n")
-		}
-		i.file.Close()
 	})
+	return
+}
 
-	// Prioritize err1
-	if err1 != nil {
-		i.logS.Debugf("ifile: %s: err1 occured", i.filePath)
-		err = err1
-	} else if err2 != nil {
-		i.logS.Debugf("ifile: %s: err2 occured", i.filePath)
-		err = err2
+// Discard closes the ifile without writing it.
+func (i *Ifile) Discard() {
+	i.once.Do(i.discard)
+}
+
+// Unchanged reports whether the ifile was identical, and wasn't written by Close.
+func (i *Ifile) Unchanged() bool { return i.unchanged }
+
+func (i *Ifile) close() (err error) {
+	i.bufMu.Lock()
+	defer i.bufMu.Unlock()
+
+	w := i.writer()
+	if len(i.end) != 0 {
+		i.logS.Debugf("ifile: %s: writing i.end", i.filePath)
+		_, err = w.Write(i.end)
+	} else if i.mode.hasIndicators() {
+		i.logS.Debugf("ifile: %s: writing newline", i.filePath)
+		_, err = w.WriteString("\n")
 	}
-	return
+	if err != nil {
+		return err
+	}
+
+	if i.stream {
+		err = i.w.Flush()
+		if err != nil {
+			return err
+		}
+		i.unchanged, err = sameContent(i.tmp, i.filePath)
+		if err != nil {
+			return err
+		}
+	} else {
+		existing, err := os.ReadFile(i.filePath)
+		i.unchanged = err == nil && bytes.Equal(existing, i.buf.Bytes())
+	}
+	if i.unchanged {
+		i.logS.Debugf("ifile: %s: unchanged", i.filePath)
+		i.discard()
+		return nil
+	}
+
+	if !i.stream {
+		err = i.createTemp()
+		if err != nil {
+			return err
+		}
+		i.logS.Debugf("ifile: %s: writing i.buf", i.filePath)
+		_, err = i.tmp.Write(i.buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep the permissions of the existing ifile.
+	perm := fs.FileMode(0660)
+	if info, err := os.Stat(i.filePath); err == nil {
+		perm = info.Mode().Perm()
+	}
+	err = i.tmp.Chmod(perm)
+	if err != nil {
+		return err
+	}
+	err = i.tmp.Close()
+	if err != nil {
+		return err
+	}
+	i.logS.Debugf("ifile: %s: renaming %s", i.filePath, i.tmp.Name())
+	return os.Rename(i.tmp.Name(), i.filePath)
 }
 
-func (e *entry) Len() int {
-	// + 1 is for newline; + 10 is for potential '\[' and '\]'
-	return len(e.path) + 1 + 10
+// Whether the content of f is the same as the file at path.
+func sameContent(f *os.File, path string) (bool, error) {
+	other, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer other.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	otherInfo, err := other.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != otherInfo.Size() {
+		return false, nil
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	var (
+		buf      = make([]byte, 64*1024)
+		otherBuf = make([]byte, 64*1024)
+	)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return false, err
+		}
+		_, otherErr := io.ReadFull(other, otherBuf[:n])
+		if otherErr != nil {
+			return false, otherErr
+		}
+		if !bytes.Equal(buf[:n], otherBuf[:n]) {
+			return false, nil
+		}
+		if err != nil {
+			return true, nil
+		}
+	}
 }
 
 func (e *entry) String() string {
@@ -195,3 +474,40 @@ func (e *entry) String() string {
 	s = filepath.ToSlash(s)
 	return s
 }
+
+// Format the entry as a line of an ifile of mode.
+func (e *entry) format(mode Mode) string {
+	switch mode {
+	case ModeRsync:
+		s := filepath.ToSlash(e.path)
+		// Backslashes escape wildcards only if there is a wildcard in the pattern.
+		if e.contents || strings.ContainsAny(s, "*?[") {
+			s = escapeWildcards(s)
+		}
+		if e.contents {
+			s += "/*"
+		} else if e.isDir {
+			s += "/"
+		}
+		if e.include {
+			return "+ " + s + "\n"
+		}
+		return "- " + s + "\n"
+	case ModeTar:
+		return "." + escapeWildcards(filepath.ToSlash(e.path)) + "\n"
+	default:
+		return e.String()
+	}
+}
+
+func escapeWildcards(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '\\', '*', '?', '[':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -153,3 +154,146 @@ func TestIfileAppend2(t *testing.T) {
 
 	require.True(t, ifileFormRe.Match(content))
 }
+
+// Test whether streaming produces the same ifile as buffering, and the ifile
+// is left untouched until Close.
+func TestIfileStream(t *testing.T) {
+	var (
+		tempDir      = t.TempDir()
+		bufferedFile = filepath.Join(tempDir, "buffered")
+		streamedFile = filepath.Join(tempDir, "streamed")
+		content      = "# This is a comment.\n\n" + generatedBy + "\n" + beginIndicator + "\n/old/entry\n" + endIndicator + "\n/entry/after/end\n"
+	)
+	path, err := filepath.Abs("../..")
+	require.NoError(t, err)
+
+	for _, mode := range []Mode{ModeSyncthing, ModeRestic} {
+		for _, appendToExisting := range []bool{false, true} {
+			for _, file := range []string{bufferedFile, streamedFile} {
+				err := os.WriteFile(file, []byte(content), 0644)
+				require.NoError(t, err)
+			}
+
+			i, err := New(bufferedFile, mode, appendToExisting, zap.NewNop())
+			require.NoError(t, err)
+			err = i.Walk(path)
+			require.NoError(t, err)
+			err = i.Close()
+			require.NoError(t, err)
+
+			i, err = NewWithOptions(streamedFile, mode, appendToExisting, &Options{Stream: true}, zap.NewNop())
+			require.NoError(t, err)
+			err = i.Walk(path)
+			require.NoError(t, err)
+			c, err := os.ReadFile(streamedFile)
+			require.NoError(t, err)
+			require.Equal(t, content, string(c))
+			err = i.Close()
+			require.NoError(t, err)
+
+			buffered, err := os.ReadFile(bufferedFile)
+			require.NoError(t, err)
+			streamed, err := os.ReadFile(streamedFile)
+			require.NoError(t, err)
+			require.Equal(t, string(buffered), string(streamed))
+
+			info, err := os.Stat(streamedFile)
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+		}
+	}
+
+	// No temporary files are left behind.
+	dirEntries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, dirEntries, 2)
+}
+
+// Test whether an identical ifile is not written again, and a changed one is replaced.
+func TestIfileUnchanged(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		var (
+			root      = t.TempDir()
+			testIfile = filepath.Join(root, ".stignore")
+		)
+		err := os.WriteFile(filepath.Join(root, ".gitignore"), []byte("ignored"), 0644)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(root, "ignored"), nil, 0644)
+		require.NoError(t, err)
+
+		generate := func() bool {
+			i, err := NewWithOptions(testIfile, ModeSyncthing, true, &Options{Stream: stream}, zap.NewNop())
+			require.NoError(t, err)
+			err = i.Walk(root)
+			require.NoError(t, err)
+			err = i.Close()
+			require.NoError(t, err)
+			return i.Unchanged()
+		}
+
+		require.False(t, generate())
+		info, err := os.Stat(testIfile)
+		require.NoError(t, err)
+
+		// Make sure the file is not rewritten.
+		old := time.Now().Add(-time.Hour).Truncate(time.Second)
+		err = os.Chtimes(testIfile, old, old)
+		require.NoError(t, err)
+		require.True(t, generate())
+		info2, err := os.Stat(testIfile)
+		require.NoError(t, err)
+		require.True(t, info2.ModTime().Equal(old))
+		require.True(t, os.SameFile(info, info2))
+
+		err = os.WriteFile(filepath.Join(root, ".gitignore"), []byte("ignored2"), 0644)
+		require.NoError(t, err)
+		require.False(t, generate())
+		content, err := os.ReadFile(testIfile)
+		require.NoError(t, err)
+		require.NotContains(t, string(content), "/ignored\n")
+
+		// No temporary files are left behind.
+		dirEntries, err := os.ReadDir(root)
+		require.NoError(t, err)
+		require.Len(t, dirEntries, 3)
+	}
+}
+
+// Test whether discarding the ifile in the middle of a walk, as `kopyat ifile`
+// does when it is interrupted, leaves the existing ifile intact.
+func TestIfileDiscardDuringWalk(t *testing.T) {
+	path, err := filepath.Abs("../..")
+	require.NoError(t, err)
+
+	for _, stream := range []bool{false, true} {
+		var (
+			tempDir   = t.TempDir()
+			testIfile = filepath.Join(tempDir, ".stignore")
+			content   = "# This is a comment.\n\n" + generatedBy + "\n" + beginIndicator + "\n/old/entry\n" + endIndicator + "\n"
+		)
+		err := os.WriteFile(testIfile, []byte(content), 0644)
+		require.NoError(t, err)
+
+		i, err := NewWithOptions(testIfile, ModeSyncthing, true, &Options{Stream: stream}, zap.NewNop())
+		require.NoError(t, err)
+		walked := make(chan struct{})
+		go func() {
+			defer close(walked)
+			i.Walk(path)
+		}()
+		i.Discard()
+		<-walked
+		// Closing after discarding (as the deferred Close does) must not write it either.
+		err = i.Close()
+		require.NoError(t, err)
+
+		c, err := os.ReadFile(testIfile)
+		require.NoError(t, err)
+		require.Equal(t, content, string(c))
+
+		// No temporary files are left behind.
+		dirEntries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		require.Len(t, dirEntries, 1)
+	}
+}
@@ -0,0 +1,50 @@
+package ifile
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// couldInclude reports whether a .kopyatinclude might include an entry inside the
+// directory at dirPath, so that it has to be walked even if it is excluded. Patterns
+// without a slash (e.g. `.env`) match at any depth, so they might match inside any
+// directory. Patterns with a slash (e.g. `data/local.db`) might match only inside
+// the directories on their path.
+func couldInclude(ignorefiles []*ignorefile, dirPath string) bool {
+	for _, igFile := range ignorefiles {
+		if !igFile.include || !isInDir(dirPath, igFile.dir) {
+			continue
+		}
+		rel := strings.Trim(filepath.ToSlash(dirPath[len(igFile.dir):]), "/")
+		for _, pattern := range igFile.p.Patterns {
+			if !pattern.Negate() && mightMatchInside(pattern.Pattern(), rel) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mightMatchInside reports whether pattern might match a path inside dir. dir is
+// relative to the directory of the pattern, and separated by slashes.
+func mightMatchInside(pattern, dir string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		return true
+	}
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	for i, name := range strings.Split(dir, "/") {
+		if i >= len(segments) {
+			// The pattern matches a parent directory, and everything inside it.
+			return true
+		}
+		if segments[i] == "**" {
+			return true
+		}
+		if ok, err := path.Match(segments[i], name); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package ifile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var includeTree = testTree{files: map[string]string{
+	".gitignore":                ".env\n*.db\nsecrets/\nbuild/\nnode_modules/\n",
+	".kopyatinclude":            ".env\nsecrets/\nbuild/keep\n",
+	".env":                      "",
+	"local.db":                  "",
+	"secrets/key":               "",
+	"build/out":                 "",
+	"build/keep":                "",
+	"node_modules/pkg/index.js": "",
+	"sub/important.log":         "",
+	"sub/other.log":             "",
+	"nested/.env":               "",
+	// Nested files take precedence.
+	"sub/.gitignore":     "*.log\n",
+	"sub/.kopyatinclude": "important.log\n",
+	"nested/.gitignore":  ".env\n",
+}}
+
+func checkWalkInclude(t *testing.T, root string, workers int) {
+	path := func(rel string) string {
+		return filepath.ToSlash(filepath.Join(root, rel))
+	}
+
+	lines := walkToLines(t, root, ModeRestic, &Options{Workers: workers})
+	for _, included := range []string{".env", "secrets/key", "build/keep", "sub/important.log"} {
+		require.Contains(t, lines, path(included))
+	}
+	for _, excluded := range []string{"local.db", "build", "build/out", "node_modules/pkg/index.js", "sub/other.log", "nested/.env"} {
+		require.NotContains(t, lines, path(excluded))
+	}
+
+	// An excluded directory with included entries inside is written entry by entry.
+	lines = walkToLines(t, root, ModeSyncthing, &Options{Workers: workers})
+	for _, excluded := range []string{"/local.db", "/build/out", "/node_modules", "/sub/other.log", "/nested/.env"} {
+		require.Contains(t, lines, excluded)
+	}
+	for _, included := range []string{"/.env", "/secrets", "/build", "/build/keep", "/sub/important.log"} {
+		require.NotContains(t, lines, included)
+	}
+}
+
+func TestTreeUpdateInclude(t *testing.T) {
+	root := createTree(t, includeTree)
+	for _, mode := range []Mode{ModeRestic, ModeSyncthing} {
+		tree := NewTree(root, mode, nil)
+		err := tree.Build()
+		require.NoError(t, err)
+		requireSameAsWalk(t, tree)
+
+		// Inside an excluded directory, which is walked for build/keep.
+		mustWriteFile(t, filepath.Join(root, "build", "out2"), "")
+		err = tree.Update(filepath.Join(root, "build", "out2"))
+		require.NoError(t, err)
+		requireSameAsWalk(t, tree)
+
+		err = os.Remove(filepath.Join(root, "build", "keep"))
+		require.NoError(t, err)
+		err = tree.Update(filepath.Join(root, "build", "keep"))
+		require.NoError(t, err)
+		requireSameAsWalk(t, tree)
+
+		mustWriteFile(t, filepath.Join(root, ".kopyatinclude"), "local.db\n")
+		err = tree.Update(filepath.Join(root, ".kopyatinclude"))
+		require.NoError(t, err)
+		requireSameAsWalk(t, tree)
+
+		mustWriteFile(t, filepath.Join(root, ".kopyatinclude"), ".env\nsecrets/\nbuild/keep\n")
+		mustWriteFile(t, filepath.Join(root, "build", "keep"), "")
+		err = os.Remove(filepath.Join(root, "build", "out2"))
+		require.NoError(t, err)
+	}
+}
+
+func TestMightMatchInside(t *testing.T) {
+	tests := []struct {
+		pattern, dir string
+		expected     bool
+	}{
+		{".env", "node_modules", true},
+		{"secrets/", "a/b", true},
+		{"data/local.db", "data", true},
+		{"/data/local.db", "data", true},
+		{"data/local.db", "other", false},
+		{"data/local.db", "data/sub", false},
+		{"/data", "data/sub", true},
+		{"d*/local.db", "data", true},
+		{"a/**/b", "a/x/y", true},
+		{"a/b/c", "a/x", false},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, mightMatchInside(test.pattern, test.dir), "pattern: %s, dir: %s", test.pattern, test.dir)
+	}
+}
+
+// Changes inside excluded directories that are walked for a .kopyatinclude are not noise.
+func TestWatchFilterInclude(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "build/\ncache/\n")
+	mustWriteFile(t, filepath.Join(root, ".kopyatinclude"), "build/keep\n")
+	filter := newWatchFilter(root, "", nil)
+	require.False(t, filter.isNoise(filepath.Join(root, "build", "keep")))
+	require.True(t, filter.isNoise(filepath.Join(root, "build", "sub", "file")))
+	require.True(t, filter.isNoise(filepath.Join(root, "cache", "file")))
+}
@@ -0,0 +1,71 @@
+package ifile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Marker of cache directories, written by e.g. cargo and ccache. It counts only if
+	// it starts with the signature. See https://bford.info/cachedir/
+	CachedirTag          = "CACHEDIR.TAG"
+	cachedirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// Whether name is the name of a marker file.
+func (l *ignoreLoader) isMarker(name string) bool {
+	for _, m := range l.markers {
+		if name == m {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the path of the marker file in dir, or an empty string if there is none.
+func (l *ignoreLoader) marker(dir string) (string, error) {
+	for _, name := range l.markers {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if name == CachedirTag {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			valid, err := hasCachedirTagSignature(path)
+			if err != nil {
+				return "", err
+			} else if !valid {
+				continue
+			}
+		}
+		return path, nil
+	}
+	return "", nil
+}
+
+func hasCachedirTagSignature(path string) (bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, len(cachedirTagSignature))
+	_, err = io.ReadFull(f, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(buf, []byte(cachedirTagSignature)), nil
+}
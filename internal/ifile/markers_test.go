@@ -0,0 +1,119 @@
+package ifile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testMarkers = []string{CachedirTag, ".nobackup"}
+
+var markersTree = testTree{files: map[string]string{
+	".kopyatinclude":        "target/keep\n",
+	"target/" + CachedirTag: cachedirTagSignature + "\n# This file is a cache directory tag.\n",
+	"target/keep":           "",
+	"target/debug/main":     "",
+	// Without the signature, CACHEDIR.TAG doesn't count.
+	"fake/" + CachedirTag: "not a cache\n",
+	"fake/file":           "",
+	"private/.nobackup":   "",
+	"private/file":        "",
+	"src/main.go":         "",
+}}
+
+func checkWalkMarkers(t *testing.T, root string, workers int) {
+	lines := walkToLines(t, root, ModeSyncthing, &Options{Workers: workers, Markers: testMarkers})
+	require.Contains(t, lines, "/target")
+	require.Contains(t, lines, "/private")
+	require.NotContains(t, lines, "/fake")
+	require.NotContains(t, lines, "/fake/file")
+
+	lines = walkToLines(t, root, ModeRestic, &Options{Workers: workers, Markers: testMarkers})
+	require.Contains(t, lines, filepath.Join(root, "src", "main.go"))
+	require.Contains(t, lines, filepath.Join(root, "fake", "file"))
+	// Marker files win over .kopyatinclude.
+	require.NotContains(t, lines, filepath.Join(root, "target", "keep"))
+	require.NotContains(t, lines, filepath.Join(root, "private", "file"))
+
+	// Markers are not read unless they are set.
+	lines = walkToLines(t, root, ModeRestic, &Options{Workers: workers})
+	require.Contains(t, lines, filepath.Join(root, "private", "file"))
+
+	lines = walkToLines(t, root, ModeSyncthingPatterns, &Options{Workers: workers, Markers: testMarkers})
+	require.Equal(t, []string{
+		generatedBy,
+		beginIndicator,
+		"// markers",
+		"/private",
+		"/target",
+		"// .kopyatinclude",
+		"!/target/keep",
+		endIndicator,
+		"",
+	}, lines)
+}
+
+func TestExplainMarkers(t *testing.T) {
+	root := createTree(t, markersTree)
+	opts := &Options{Markers: testMarkers}
+
+	e, err := Explain(root, filepath.Join(root, "target", "keep"), opts)
+	require.NoError(t, err)
+	require.True(t, e.Excluded)
+	require.Equal(t, filepath.Join(root, "target"), e.ExcludedDir)
+	require.Equal(t, filepath.Join(root, "target", CachedirTag), e.Marker)
+
+	e, err = Explain(root, filepath.Join(root, "private"), opts)
+	require.NoError(t, err)
+	require.True(t, e.Excluded)
+	require.Equal(t, filepath.Join(root, "private", ".nobackup"), e.Marker)
+
+	e, err = Explain(root, filepath.Join(root, "fake", "file"), opts)
+	require.NoError(t, err)
+	require.False(t, e.Excluded)
+	require.Empty(t, e.Marker)
+}
+
+func TestWatchFilterMarkers(t *testing.T) {
+	root := createTree(t, markersTree)
+	filter := newWatchFilter(root, "", &Options{Markers: testMarkers})
+	require.True(t, filter.isNoise(filepath.Join(root, "target", "debug", "main")))
+	require.True(t, filter.isNoise(filepath.Join(root, "target", "keep")))
+	require.False(t, filter.isNoise(filepath.Join(root, "target", CachedirTag)))
+	require.False(t, filter.isNoise(filepath.Join(root, "fake", "file")))
+	require.Equal(t, []string{
+		filepath.Join(root, "private", CachedirTag),
+		filepath.Join(root, "private", ".nobackup"),
+	}, filter.exceptions(filepath.Join(root, "private")))
+	require.Empty(t, filter.exceptions(filepath.Join(root, "src")))
+
+	err := os.Remove(filepath.Join(root, "private", ".nobackup"))
+	require.NoError(t, err)
+	filter.invalidate(filepath.Join(root, "private"))
+	require.False(t, filter.isNoise(filepath.Join(root, "private", "file")))
+}
+
+func TestWatchMarkers(t *testing.T) {
+	for _, opts := range []*WatchJobOptions{
+		{Ifile: Options{Markers: testMarkers}},
+		{Ifile: Options{Markers: testMarkers}, Incremental: true},
+		{Ifile: Options{Markers: testMarkers}, Poll: true, PollInterval: 50 * time.Millisecond},
+	} {
+		j := newTempWatchJob(t, opts, func(scanPath string) {
+			mustWriteFile(t, filepath.Join(scanPath, "cache", "file"), "")
+		})
+		j.start(t)
+		waitFor(t, func() bool { return j.walks() > 0 })
+		require.False(t, j.hasLine("/cache"))
+
+		mustWriteFile(t, filepath.Join(j.scanPath, "cache", ".nobackup"), "")
+		waitFor(t, func() bool { return j.hasLine("/cache") })
+
+		err := os.Remove(filepath.Join(j.scanPath, "cache", ".nobackup"))
+		require.NoError(t, err)
+		waitFor(t, func() bool { return !j.hasLine("/cache") })
+	}
+}
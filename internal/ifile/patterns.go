@@ -0,0 +1,347 @@
+package ifile
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Return the ignore files of the walked directories, parents before children.
+// Should be called with mu locked.
+func (t *Tree) ignorefiles() (ignorefiles []*ignorefile) {
+	var add func(node *treeNode)
+	add = func(node *treeNode) {
+		ignorefiles = append(ignorefiles, node.ignorefiles...)
+		for _, child := range node.children {
+			add(child)
+		}
+	}
+	add(t.node)
+	return
+}
+
+// Return the paths of the entries that match, in preorder. Should be called with mu locked.
+func (t *Tree) paths(match func(node *treeNode) bool) (paths []string) {
+	var add func(node *treeNode, path string)
+	add = func(node *treeNode, path string) {
+		for _, child := range node.children {
+			childPath := filepath.Join(path, child.name)
+			if match(child) {
+				paths = append(paths, childPath)
+			}
+			add(child, childPath)
+		}
+	}
+	add(t.node, t.root)
+	return
+}
+
+// Files excluded by the filters.
+func (t *Tree) filteredPaths() []string {
+	return t.paths(func(node *treeNode) bool { return node.filtered })
+}
+
+// Directories excluded by marker files.
+func (t *Tree) markedPaths() []string {
+	return t.paths(func(node *treeNode) bool { return node.marked })
+}
+
+// Directories on other file systems.
+func (t *Tree) mountPointPaths() []string {
+	return t.paths(func(node *treeNode) bool { return node.mountPoint })
+}
+
+// Write the patterns of the ignore files, translated to the syntax of the ifile
+// (ModeSyncthingPatterns or ModeResticExclude). Should be called with bufMu locked.
+//
+// Filters, marker files and mount points can't be translated, so the files the
+// filters exclude (filtered), the directories marker files exclude (marked), and
+// the directories on other file systems (mountPoints) are written as paths.
+//
+// Unlike gitignore, the first matching pattern decides in syncthing. So the ignore
+// files are written from the highest precedence to the lowest (children before
+// parents, and .kopyatinclude before the ignore files of the same directory),
+// and the patterns of each ignore file are written from the last to the first.
+// The paths come first, so that nothing includes them again.
+//
+// In restic, the last matching pattern decides, as in gitignore. So everything is
+// written in the opposite order, and the paths come last.
+func (i *Ifile) writePatterns(root string, ignorefiles []*ignorefile, filtered, marked, mountPoints []string) error {
+	writePaths := func() error {
+		err := i.writePaths(root, "filters", filtered)
+		if err != nil {
+			return err
+		}
+		err = i.writePaths(root, "markers", marked)
+		if err != nil {
+			return err
+		}
+		return i.writePaths(root, "mount points", mountPoints)
+	}
+	if i.mode == ModeResticExclude {
+		for _, igFile := range ignorefiles {
+			err := i.writeIgnorefile(root, ignorefiles, igFile)
+			if err != nil {
+				return err
+			}
+		}
+		return writePaths()
+	}
+
+	err := writePaths()
+	if err != nil {
+		return err
+	}
+	for j := len(ignorefiles) - 1; j >= 0; j-- {
+		err = i.writeIgnorefile(root, ignorefiles, ignorefiles[j])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the translated patterns of the ignore file (one of ignorefiles) after a
+// comment with its path. Should be called with bufMu locked.
+func (i *Ifile) writeIgnorefile(root string, ignorefiles []*ignorefile, igFile *ignorefile) error {
+	lines := i.translate(root, ignorefiles, igFile)
+	if len(lines) == 0 {
+		return nil
+	}
+	source := igFile.path
+	if isInDir(source, root) {
+		source = filepath.ToSlash(strings.TrimPrefix(source[len(root):], string(filepath.Separator)))
+	}
+	err := i.writeComment(source)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		err = i.writePattern(line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Translate the patterns of the ignore file (one of ignorefiles) to the syntax
+// of the ifile, in the order they are written.
+func (i *Ifile) translate(root string, ignorefiles []*ignorefile, igFile *ignorefile) (lines []string) {
+	n := len(igFile.p.Patterns)
+	for k := 0; k < n; k++ {
+		pattern := igFile.p.Patterns[k]
+		if i.mode == ModeSyncthingPatterns {
+			pattern = igFile.p.Patterns[n-1-k]
+		}
+		if igFile.include && pattern.Negate() {
+			// It only means that the path is not forcibly included, and the
+			// ignore files decide. This cannot be expressed in syncthing or restic.
+			continue
+		}
+		if pattern.Negate() && negatesInExcludedDir(root, ignorefiles, igFile, pattern.Pattern()) {
+			continue
+		}
+		include := igFile.include || pattern.Negate()
+		prefix := ""
+		if include {
+			prefix += "!"
+		}
+		p := strings.TrimPrefix(pattern.Pattern(), "!")
+
+		var translated []string
+		if i.mode == ModeResticExclude {
+			translated = resticPatterns(p, igFile.dir)
+		} else {
+			if i.caseInsensitive {
+				prefix += "(?i)"
+			}
+			if i.deletable && !include {
+				prefix += "(?d)"
+			}
+			dir := ""
+			if isInDir(igFile.dir, root) {
+				dir = filepath.ToSlash(strings.TrimPrefix(igFile.dir[len(root):], string(filepath.Separator)))
+			}
+			translated = syncthingPatterns(p, dir)
+		}
+		for _, t := range translated {
+			lines = append(lines, prefix+t)
+		}
+	}
+	return
+}
+
+// In gitignore, a negated pattern can't include a path again if a parent directory
+// of it is excluded. Syncthing and restic include it, so report whether the negated
+// pattern (with the `!` prefix) of igFile is inside an excluded directory: the
+// directory of igFile, or a parent directory the pattern names literally.
+func negatesInExcludedDir(root string, ignorefiles []*ignorefile, igFile *ignorefile, pattern string) bool {
+	var dirs []string
+	if isInDir(igFile.dir, root) {
+		dir := root
+		for _, part := range strings.Split(igFile.dir[len(root):], string(filepath.Separator)) {
+			if part != "" {
+				dir = filepath.Join(dir, part)
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "!"), "/")
+	// Patterns without a slash in the middle match at any depth, and name no parents.
+	if strings.Contains(strings.TrimPrefix(pattern, "/"), "/") {
+		parts := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+		dir := igFile.dir
+		for _, part := range parts[:len(parts)-1] {
+			if strings.ContainsAny(part, `*?[\`) {
+				break
+			}
+			dir = filepath.Join(dir, part)
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		if excluded(ignorefiles, dir, true, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write the paths after a comment with source, as exclude patterns that match only them.
+// Should be called with bufMu locked.
+func (i *Ifile) writePaths(root, source string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	prefix := ""
+	if i.deletable && i.mode == ModeSyncthingPatterns {
+		prefix = "(?d)"
+	}
+	err := i.writeComment(source)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		rel := filepath.ToSlash(i.mode.excludedPath(root, path))
+		if i.mode == ModeResticExclude {
+			rel = escapeResticPath(rel)
+		} else {
+			rel = escapeGlob(rel)
+		}
+		err = i.writePattern(prefix + rel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Comments start with `//` in .stignore, and with `#` in restic's exclude files.
+// Should be called with bufMu locked.
+func (i *Ifile) writeComment(comment string) error {
+	prefix := "# "
+	if i.mode == ModeSyncthingPatterns {
+		prefix = "// "
+	}
+	_, err := i.writer().WriteString(prefix + comment + "\n")
+	return err
+}
+
+// Should be called with bufMu locked.
+func (i *Ifile) writePattern(pattern string) error {
+	if i.mode == ModeResticExclude {
+		// restic expands environment variables in exclude files.
+		pattern = strings.ReplaceAll(pattern, "$", "$$")
+	}
+	_, err := i.writer().WriteString(pattern + "\n")
+	return err
+}
+
+// Translate a gitignore pattern (without the `!` prefix) of an ignore file in dir
+// into syncthing patterns. dir is relative to the walked directory, and separated
+// by slashes.
+//
+// Syncthing has no directory-only patterns, so `dir/` becomes `dir/**`, which
+// matches the contents of the directory, but not the directory itself.
+func syncthingPatterns(pattern, dir string) []string {
+	if dir != "" {
+		dir = "/" + escapeGlob(dir)
+	}
+	return globPatterns(pattern, dir)
+}
+
+// Translate a gitignore pattern (without the `!` prefix) of an ignore file in the
+// absolute directory dir into restic exclude patterns, anchored at dir.
+//
+// As in syncthing, `dir/` becomes `dir/**`.
+func resticPatterns(pattern, dir string) []string {
+	return globPatterns(pattern, escapeResticPath(filepath.ToSlash(dir)))
+}
+
+// Translate a gitignore pattern (without the `!` prefix) into glob patterns anchored
+// at dir. dir is escaped, and separated by slashes. If dir is empty, the patterns
+// that match at any depth don't begin with a slash.
+func globPatterns(pattern, dir string) (patterns []string) {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	// A pattern with a slash at the beginning or in the middle is relative to the
+	// directory of the ignore file. Otherwise, it matches at any depth.
+	anywhere := !strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if strings.HasPrefix(pattern, "**/") {
+		anywhere = true
+		pattern = pattern[len("**/"):]
+	}
+	if pattern == "" {
+		return nil
+	}
+
+	for _, p := range expandDoubleStar(pattern) {
+		if dirOnly {
+			p += "/**"
+		}
+		switch {
+		case anywhere && dir == "":
+			// Syncthing matches the patterns that don't begin with a slash at any depth.
+			patterns = append(patterns, p)
+		case anywhere:
+			patterns = append(patterns, dir+"/"+p, dir+"/**/"+p)
+		default:
+			patterns = append(patterns, dir+"/"+p)
+		}
+	}
+	return
+}
+
+// In gitignore, `a/**/b` matches `a/b` too, but in syncthing, `**` in the middle
+// matches at least one directory. Return the pattern with each `/**/` as both
+// `/` and `/**/`.
+func expandDoubleStar(pattern string) []string {
+	idx := strings.Index(pattern, "/**/")
+	if idx == -1 {
+		return []string{pattern}
+	}
+	var patterns []string
+	for _, rest := range expandDoubleStar(pattern[idx+len("/**/"):]) {
+		patterns = append(patterns, pattern[:idx]+"/"+rest, pattern[:idx]+"/**/"+rest)
+	}
+	return patterns
+}
+
+// Escape the wildcards in a path, so that syncthing matches it literally.
+// Backslashes are path separators on Windows, and can't be used to escape.
+func escapeGlob(path string) string {
+	if runningOnWindows {
+		return path
+	}
+	return strings.NewReplacer("{", `\{`, "}", `\}`).Replace(escapeWildcards(path))
+}
+
+// Escape the wildcards in a path, so that restic matches it literally.
+// Backslashes are path separators on Windows, and can't be used to escape.
+func escapeResticPath(path string) string {
+	if runningOnWindows {
+		return path
+	}
+	return escapeWildcards(path)
+}
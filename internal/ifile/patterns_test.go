@@ -0,0 +1,96 @@
+package ifile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSyncthingPatterns(t *testing.T) {
+	tests := []struct {
+		pattern, dir string
+		expected     []string
+	}{
+		{"*.log", "", []string{"*.log"}},
+		{"*.log", "sub", []string{"/sub/*.log", "/sub/**/*.log"}},
+		{"/build", "", []string{"/build"}},
+		{"/build", "sub", []string{"/sub/build"}},
+		{"build/", "", []string{"build/**"}},
+		{"build/", "sub", []string{"/sub/build/**", "/sub/**/build/**"}},
+		{"docs/*.md", "", []string{"/docs/*.md"}},
+		{"**/cache", "sub", []string{"/sub/cache", "/sub/**/cache"}},
+		{"**/a/b", "", []string{"a/b"}},
+		{"a/**/b", "", []string{"/a/b", "/a/**/b"}},
+		{"a/**/b/**/c", "", []string{"/a/b/c", "/a/**/b/c", "/a/b/**/c", "/a/**/b/**/c"}},
+		{"data/**", "", []string{"/data/**"}},
+	}
+	for _, test := range tests {
+		require.ElementsMatch(t, test.expected, syncthingPatterns(test.pattern, test.dir), "pattern: %s, dir: %s", test.pattern, test.dir)
+	}
+
+	// As in git, negated patterns don't include paths inside excluded directories
+	// again. They are dropped, as syncthing would include them.
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "build/\n!build/keep\n/dist\n!/dist/sub/keep\n*.log\n!keep.log\n")
+	// sub/build is excluded by build/ of the parent directory.
+	mustWriteFile(t, filepath.Join(root, "sub", ".gitignore"), "!/build/keep\n!/other/keep\n")
+	mustWriteFile(t, filepath.Join(root, "build", "keep"), "")
+	mustWriteFile(t, filepath.Join(root, "dist", "sub", "keep"), "")
+	require.Equal(t, []string{
+		generatedBy,
+		beginIndicator,
+		"// sub/.gitignore",
+		"!/sub/other/keep",
+		"// .gitignore",
+		"!keep.log",
+		"*.log",
+		"/dist",
+		"build/**",
+		endIndicator,
+		"",
+	}, walkToLines(t, root, ModeSyncthingPatterns, nil))
+}
+
+func TestWalkSyncthingPatterns(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "*.log\n!keep.log\nbuild/\n")
+	mustWriteFile(t, filepath.Join(root, ".kopyatinclude"), "build/keep\n")
+	mustWriteFile(t, filepath.Join(root, "sub", ".kopyatignore"), "/tmp\n")
+	mustWriteFile(t, filepath.Join(root, "build", "out"), "")
+	mustWriteFile(t, filepath.Join(root, "build", "keep"), "")
+	// Ignore files inside excluded directories don't apply.
+	mustWriteFile(t, filepath.Join(root, "excluded.log", ".gitignore"), "*\n")
+
+	for _, workers := range []int{1, 4} {
+		testIfile := filepath.Join(t.TempDir(), "ifile")
+		opts := &Options{Workers: workers, CaseInsensitive: true, Deletable: true}
+		i, err := NewWithOptions(testIfile, ModeSyncthingPatterns, false, opts, zap.NewNop())
+		require.NoError(t, err)
+		err = i.Walk(root)
+		require.NoError(t, err)
+		err = i.Close()
+		require.NoError(t, err)
+		content, err := os.ReadFile(testIfile)
+		require.NoError(t, err)
+
+		// The first matching pattern decides in syncthing.
+		require.Equal(t, []string{
+			generatedBy,
+			beginIndicator,
+			"// sub/.kopyatignore",
+			"(?i)(?d)/sub/tmp",
+			"// .kopyatinclude",
+			"!(?i)/build/keep",
+			"// .gitignore",
+			"(?i)(?d)build/**",
+			"!(?i)keep.log",
+			"(?i)(?d)*.log",
+			endIndicator,
+			"",
+		}, strings.Split(string(content), "\n"), "workers: %d", workers)
+	}
+}
@@ -0,0 +1,179 @@
+package ifile
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const defaultPollInterval = 10 * time.Second
+
+// pollWatcher is used where fsnotify doesn't work (e.g. network filesystems), or
+// can't register any more watches. It compares snapshots of the directories and
+// ignore files on each interval, and reports the paths that have changed.
+type pollWatcher struct {
+	root     string
+	interval time.Duration
+	filter   *watchFilter
+	snapshot map[string]pollEntry
+	// Directories the last walk couldn't read. See watch.
+	unreadable func() []string
+
+	eventChan chan string
+	errChan   chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type pollEntry struct {
+	modTime time.Time
+	size    int64
+}
+
+func newPollWatcher(root, ifile string, opts *Options, interval time.Duration, unreadable func() []string) (*pollWatcher, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	p := &pollWatcher{
+		root:       root,
+		interval:   interval,
+		filter:     newWatchFilter(root, ifile, opts),
+		unreadable: unreadable,
+		eventChan:  make(chan string, 1),
+		errChan:    make(chan error),
+		closed:     make(chan struct{}),
+	}
+	var err error
+	p.snapshot, err = p.take()
+	if err != nil {
+		return nil, err
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *pollWatcher) Events() chan string  { return p.eventChan }
+func (p *pollWatcher) Errors() <-chan error { return p.errChan }
+
+func (p *pollWatcher) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *pollWatcher) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.closed:
+			return
+		}
+
+		snapshot, err := p.take()
+		if err != nil {
+			select {
+			case p.errChan <- err:
+			case <-p.closed:
+			}
+			return
+		}
+		changed := diffSnapshots(p.snapshot, snapshot)
+		p.snapshot = snapshot
+		// Changes of permissions don't change the modification time.
+		for _, path := range p.unreadable() {
+			if _, err := readDir(path); err == nil && !slices.Contains(changed, path) {
+				changed = append(changed, path)
+			}
+		}
+		if len(changed) > 0 {
+			// Ignore files might have changed.
+			p.filter.invalidate(p.root)
+		}
+		for _, path := range changed {
+			select {
+			case p.eventChan <- path:
+			case <-p.closed:
+				return
+			}
+		}
+	}
+}
+
+// Take a snapshot of the directories and ignore files, except the noisy ones.
+// Modification time of a directory changes when an entry is created, removed,
+// or renamed inside it.
+func (p *pollWatcher) take() (map[string]pollEntry, error) {
+	snapshot := make(map[string]pollEntry)
+	err := filepath.WalkDir(p.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The entry might have been removed after its directory was read.
+			if path != p.root && (errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrNotExist)) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && !p.filter.ignores.isIgnorefile(d.Name()) {
+			return nil
+		}
+		if d.IsDir() && p.filter.isNoise(filepath.Join(path, "_")) {
+			p.takeExceptions(snapshot, path)
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		snapshot[path] = pollEntry{modTime: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range p.filter.gitExcludesFiles() {
+		if isInDir(path, p.root) {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			snapshot[path] = pollEntry{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return snapshot, nil
+}
+
+// Add the paths inside dir that are not noise, although its other contents are, to
+// the snapshot. E.g. marker files of a directory excluded by one.
+func (p *pollWatcher) takeExceptions(snapshot map[string]pollEntry, dir string) {
+	for _, path := range p.filter.exceptions(dir) {
+		info, err := os.Lstat(path)
+		if err != nil {
+			continue
+		}
+		snapshot[path] = pollEntry{modTime: info.ModTime(), size: info.Size()}
+		if info.IsDir() {
+			p.takeExceptions(snapshot, path)
+		}
+	}
+}
+
+// Return the paths that are created, removed, or modified.
+func diffSnapshots(old, new map[string]pollEntry) (changed []string) {
+	for path, entry := range new {
+		if oldEntry, ok := old[path]; !ok || !oldEntry.modTime.Equal(entry.modTime) || oldEntry.size != entry.size {
+			changed = append(changed, path)
+		}
+	}
+	for path := range old {
+		if _, ok := new[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package ifile
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Totals are numbers of the files (entries that are not directories) that
+// are included and excluded, and size of the excluded ones.
+type Totals struct {
+	FilesIncluded int
+	FilesExcluded int
+	BytesExcluded int64
+	// Directories that couldn't be read, and were skipped.
+	Unreadable []Unreadable
+}
+
+func (t *Totals) Add(other Totals) {
+	t.FilesIncluded += other.FilesIncluded
+	t.FilesExcluded += other.FilesExcluded
+	t.BytesExcluded += other.BytesExcluded
+	t.Unreadable = append(t.Unreadable, other.Unreadable...)
+}
+
+// WalkWithTotals walks root like Walk does, and counts the included and excluded files.
+// It keeps the whole directory in memory, and walks the excluded directories too.
+func (i *Ifile) WalkWithTotals(root string) (totals Totals, err error) {
+	t := NewTree(root, i.mode, &Options{Workers: i.workers})
+	t.ignores = i.ignores
+	err = t.Build()
+	if err != nil {
+		return
+	}
+	err = i.WriteTree(t)
+	if err != nil {
+		return
+	}
+	return t.Totals()
+}
+
+// Totals counts the included and excluded files of the tree.
+func (t *Tree) Totals() (totals Totals, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.node == nil {
+		return
+	}
+	err = t.count(&totals, t.node, t.root)
+	totals.Unreadable = t.unreadable(t.node, t.root)
+	return
+}
+
+func (t *Tree) count(totals *Totals, node *treeNode, path string) error {
+	for _, child := range node.children {
+		childPath := filepath.Join(path, child.name)
+		switch {
+		case child.mountPoint:
+			// Other file systems are not walked.
+		case child.isDir && child.excluded && !child.descended:
+			err := t.countExcludedDir(totals, childPath)
+			if err != nil {
+				return err
+			}
+		case child.isDir:
+			err := t.count(totals, child, childPath)
+			if err != nil {
+				return err
+			}
+		case child.excluded:
+			totals.FilesExcluded++
+			if info, err := os.Lstat(childPath); err == nil {
+				totals.BytesExcluded += info.Size()
+			}
+		default:
+			totals.FilesIncluded++
+		}
+	}
+	return nil
+}
+
+// Everything inside an excluded directory is excluded. Like Walk, unreadable directories
+// are skipped, and so are the directories on other file systems if the walk doesn't cross them.
+func (t *Tree) countExcludedDir(totals *Totals, dir string) error {
+	return walkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && t.isMountPoint(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		totals.FilesExcluded++
+		if info, err := d.Info(); err == nil {
+			totals.BytesExcluded += info.Size()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,51 @@
+package ifile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestWalkWithTotals(t *testing.T) {
+	root := createTree(t, includeTree)
+	mustWriteFile(t, filepath.Join(root, "local.db"), "0123456789")
+	mustWriteFile(t, filepath.Join(root, "node_modules", "pkg", "index.js"), "01234")
+
+	for _, mode := range []Mode{ModeRestic, ModeSyncthing} {
+		for _, workers := range []int{1, 4} {
+			var (
+				tempDir   = t.TempDir()
+				walkIfile = filepath.Join(tempDir, "walk")
+				testIfile = filepath.Join(tempDir, "totals")
+			)
+			i, err := New(walkIfile, mode, false, zap.NewNop())
+			require.NoError(t, err)
+			err = i.Walk(root)
+			require.NoError(t, err)
+			err = i.Close()
+			require.NoError(t, err)
+
+			i, err = NewWithOptions(testIfile, mode, false, &Options{Workers: workers}, zap.NewNop())
+			require.NoError(t, err)
+			totals, err := i.WalkWithTotals(root)
+			require.NoError(t, err)
+			err = i.Close()
+			require.NoError(t, err)
+
+			require.Equal(t, Totals{
+				FilesIncluded: 9,
+				FilesExcluded: 5,
+				BytesExcluded: 15,
+			}, totals)
+
+			walkContent, err := os.ReadFile(walkIfile)
+			require.NoError(t, err)
+			content, err := os.ReadFile(testIfile)
+			require.NoError(t, err)
+			require.Equal(t, string(walkContent), string(content))
+		}
+	}
+}
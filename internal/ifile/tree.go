@@ -0,0 +1,431 @@
+package ifile
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type (
+	// Tree keeps the ignore files and the entries of a directory in memory, so
+	// that after a change only the affected subtree needs to be walked again.
+	// It produces the same entries as Walk.
+	Tree struct {
+		root    string
+		mode    Mode
+		node    *treeNode
+		mu      sync.Mutex
+		workers int
+		ignores *ignoreLoader
+		// Set while building with multiple workers.
+		g *errgroup.Group
+		// Device of the root directory, if the walk shouldn't cross file systems.
+		dev   uint64
+		devOK bool
+	}
+
+	treeNode struct {
+		name     string
+		isDir    bool
+		excluded bool
+		// Whether an excluded directory is walked, because entries inside
+		// it might be included by a .kopyatinclude.
+		descended bool
+		// Whether a file is excluded by the filters.
+		filtered bool
+		// Whether an excluded directory is on another file system. It is not walked.
+		mountPoint bool
+		// Whether a directory is excluded by a marker file.
+		marked bool
+		// Why the entries of a directory couldn't be read, if they couldn't.
+		unreadable error
+		// Ignore files inside this directory.
+		ignorefiles []*ignorefile
+		// Sorted by name. Only directories that are descended into have children.
+		children []*treeNode
+	}
+)
+
+func NewTree(root string, mode Mode, opts *Options) *Tree {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return &Tree{
+		root:    root,
+		mode:    mode,
+		workers: opts.Workers,
+		ignores: newIgnoreLoader(opts),
+	}
+}
+
+// Build walks the whole directory.
+func (t *Tree) Build() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.build()
+}
+
+// Directories are walked concurrently if there are multiple workers. Each directory
+// gets its own copy of the ignore files of its parents, so that ignore files of
+// one directory don't leak into its siblings.
+func (t *Tree) build() error {
+	err := t.readDevice()
+	if err != nil {
+		return err
+	}
+	node := &treeNode{isDir: true}
+	err = t.ignores.addIgnoreIfExists(&node.ignorefiles, t.root)
+	if err != nil {
+		return err
+	}
+	if t.workers > 1 {
+		t.g = new(errgroup.Group)
+		// This goroutine is a worker too.
+		t.g.SetLimit(t.workers - 1)
+		defer func() { t.g = nil }()
+	}
+	err = t.walkChildren(node, t.root, node.ignorefiles)
+	if t.g != nil {
+		if gErr := t.g.Wait(); err == nil {
+			err = gErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	t.node = node
+	return nil
+}
+
+// Update re-evaluates path after it was created, removed, or modified. If path is an
+// ignore file, its directory is walked again. Otherwise only path is (its subtree if
+// it is a new directory, or its list of entries if it is an existing one).
+func (t *Tree) Update(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.node == nil {
+		return t.build()
+	}
+
+	path = filepath.Clean(path)
+	base := filepath.Base(path)
+	if t.ignores.isIgnorefile(base) {
+		return t.update(filepath.Dir(path), true)
+	}
+	if dir, ok := t.ignores.invalidateGitExcludes(path, t.root); ok {
+		return t.update(dir, true)
+	}
+	return t.update(path, false)
+}
+
+// Walk path again if rebuild is true, or if it is not a known directory.
+func (t *Tree) update(path string, rebuild bool) error {
+	if path == t.root || path == filepath.Clean(t.root) {
+		if rebuild {
+			return t.build()
+		}
+		return t.syncChildren(t.node, t.root, t.node.ignorefiles)
+	}
+	if !isInDir(path, t.root) {
+		return nil
+	}
+
+	dir := filepath.Dir(path)
+	parent, ignorefiles, ok := t.lookup(dir)
+	if !ok {
+		// Parent directory has changed too.
+		return t.update(dir, false)
+	} else if parent == nil {
+		// Inside an excluded directory. Nothing to do.
+		return nil
+	}
+
+	name := filepath.Base(path)
+	idx := sort.Search(len(parent.children), func(i int) bool { return parent.children[i].name >= name })
+	found := idx < len(parent.children) && parent.children[idx].name == name
+
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if found {
+			parent.children = append(parent.children[:idx], parent.children[idx+1:]...)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	isDir := t.ignores.isDir(path, info.Mode().Type())
+
+	if found && !rebuild {
+		child := parent.children[idx]
+		switch {
+		case child.isDir != isDir:
+		case !isDir && t.ignores.filters != nil:
+			// Size or age of the file might have changed. Filters decide again.
+		case !isDir || (child.excluded && !child.descended):
+			return nil
+		default:
+			return t.syncChildren(child, path, append(ignorefiles[:len(ignorefiles):len(ignorefiles)], child.ignorefiles...))
+		}
+	}
+
+	child, err := t.newNode(path, name, isDir, ignorefiles, parent.excluded)
+	if err != nil {
+		return err
+	}
+	if found {
+		parent.children[idx] = child
+	} else {
+		parent.children = append(parent.children, nil)
+		copy(parent.children[idx+1:], parent.children[idx:])
+		parent.children[idx] = child
+	}
+	return nil
+}
+
+// lookup returns the node of the directory at path, and the ignore files that apply to
+// its entries. ok is false if the directory is not in the tree. If the directory
+// or one of its parents is excluded, or is not a directory, node is nil.
+func (t *Tree) lookup(path string) (node *treeNode, ignorefiles []*ignorefile, ok bool) {
+	node = t.node
+	ignorefiles = node.ignorefiles
+	rel := strings.TrimPrefix(path[len(filepath.Clean(t.root)):], string(os.PathSeparator))
+	if rel == "" {
+		return node, ignorefiles, true
+	}
+	for _, name := range strings.Split(rel, string(os.PathSeparator)) {
+		idx := sort.Search(len(node.children), func(i int) bool { return node.children[i].name >= name })
+		if idx == len(node.children) || node.children[idx].name != name {
+			return nil, nil, false
+		}
+		node = node.children[idx]
+		if !node.isDir || (node.excluded && !node.descended) {
+			return nil, nil, true
+		}
+		ignorefiles = append(ignorefiles[:len(ignorefiles):len(ignorefiles)], node.ignorefiles...)
+	}
+	return node, ignorefiles, true
+}
+
+func (t *Tree) newNode(path, name string, isDir bool, ignorefiles []*ignorefile, parentExcluded bool) (*treeNode, error) {
+	node := &treeNode{
+		name:     name,
+		isDir:    isDir,
+		excluded: excluded(ignorefiles, path, isDir, parentExcluded),
+	}
+	if !isDir {
+		if !node.excluded {
+			var err error
+			node.filtered, err = t.ignores.filtered(path, nil)
+			node.excluded = node.filtered
+			return node, err
+		}
+		return node, nil
+	} else if t.isMountPoint(path) {
+		node.excluded = true
+		node.mountPoint = true
+		return node, nil
+	} else if node.excluded && !couldInclude(ignorefiles, path) {
+		return node, nil
+	}
+	if len(t.ignores.markers) > 0 {
+		marker, err := t.ignores.marker(path)
+		if err != nil {
+			return nil, err
+		} else if marker != "" {
+			node.excluded = true
+			node.marked = true
+			return node, nil
+		}
+	}
+	node.descended = node.excluded
+	walk := func() error {
+		err := t.ignores.addIgnoreIfExists(&node.ignorefiles, path)
+		if err != nil {
+			return err
+		}
+		return t.walkChildren(node, path, append(ignorefiles[:len(ignorefiles):len(ignorefiles)], node.ignorefiles...))
+	}
+	// If all workers are busy, walk it in this goroutine.
+	if t.g != nil && t.g.TryGo(walk) {
+		return node, nil
+	}
+	return node, walk()
+}
+
+func (t *Tree) walkChildren(node *treeNode, path string, ignorefiles []*ignorefile) error {
+	dirEntries, err := t.readDir(node, path)
+	if err != nil {
+		return err
+	}
+	node.children = make([]*treeNode, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		childPath := filepath.Join(path, d.Name())
+		child, err := t.newNode(childPath, d.Name(), t.ignores.isDir(childPath, d.Type()), ignorefiles, node.excluded)
+		if err != nil {
+			return err
+		}
+		node.children = append(node.children, child)
+	}
+	return nil
+}
+
+// Add the new entries of the directory, and remove the ones that don't exist anymore.
+// Entries that still exist are kept as they are.
+func (t *Tree) syncChildren(node *treeNode, path string, ignorefiles []*ignorefile) error {
+	dirEntries, err := t.readDir(node, path)
+	if err != nil {
+		return err
+	}
+	children := make([]*treeNode, 0, len(dirEntries))
+	j := 0
+	for _, d := range dirEntries {
+		for j < len(node.children) && node.children[j].name < d.Name() {
+			j++
+		}
+		childPath := filepath.Join(path, d.Name())
+		isDir := t.ignores.isDir(childPath, d.Type())
+		if j < len(node.children) && node.children[j].name == d.Name() && node.children[j].isDir == isDir {
+			children = append(children, node.children[j])
+			continue
+		}
+		child, err := t.newNode(childPath, d.Name(), isDir, ignorefiles, node.excluded)
+		if err != nil {
+			return err
+		}
+		children = append(children, child)
+	}
+	node.children = children
+	return nil
+}
+
+func (t *Tree) collect(c *collector, node *treeNode, path string) error {
+	for _, child := range node.children {
+		err := t.collectNode(c, child, filepath.Join(path, child.name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tree) collectNode(c *collector, node *treeNode, path string) error {
+	switch {
+	case !t.mode.listsExcluded() && node.excluded:
+		if node.descended {
+			return t.collect(c, node, path)
+		}
+		return nil
+	case t.mode.listsExcluded() && !node.excluded:
+		if node.isDir {
+			return t.collect(c, node, path)
+		}
+		return nil
+	case t.mode.listsExcluded() && node.descended && hasIncluded(node):
+		// Excluding the directory would exclude the included entries too.
+		// Write its excluded entries instead.
+		if t.mode == ModeRsync {
+			return t.collectRsyncRules(c, node, path)
+		}
+		return t.collect(c, node, path)
+	case t.mode.listsExcluded():
+		return c.add(&entry{
+			path:  t.mode.excludedPath(t.root, path),
+			isDir: node.isDir,
+		})
+	}
+
+	err := c.add(&entry{
+		path:  path,
+		isDir: node.isDir,
+	})
+	if err == nil && node.isDir {
+		err = t.collect(c, node, path)
+	}
+	return err
+}
+
+// rsync doesn't descend into excluded directories, and the first matching rule decides.
+// So the excluded directory at path and the included entries inside it are included
+// first, and then a rule excludes the rest of its entries, including the ones
+// created after the generation.
+func (t *Tree) collectRsyncRules(c *collector, node *treeNode, path string) error {
+	rel := t.mode.excludedPath(t.root, path)
+	err := c.add(&entry{path: rel, isDir: true, include: true})
+	if err != nil {
+		return err
+	}
+	for _, child := range node.children {
+		childPath := filepath.Join(path, child.name)
+		switch {
+		case !child.excluded:
+			err = c.add(&entry{
+				path:    t.mode.excludedPath(t.root, childPath),
+				isDir:   child.isDir,
+				include: true,
+			})
+			if err == nil && child.isDir {
+				err = t.collect(c, child, childPath)
+			}
+		case child.descended && hasIncluded(child):
+			err = t.collectRsyncRules(c, child, childPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.add(&entry{path: rel, isDir: true, contents: true})
+}
+
+// Whether there is an entry inside the directory that is not excluded.
+func hasIncluded(node *treeNode) bool {
+	for _, child := range node.children {
+		if !child.excluded || (child.descended && hasIncluded(child)) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkExcluded walks the excluded directory at path into a tree, and writes the
+// entries of it as WriteTree would do. Should be called with bufMu locked.
+func (i *Ifile) walkExcluded(c *collector, root, path string, ignorefiles []*ignorefile) error {
+	t := &Tree{
+		root:    root,
+		mode:    i.mode,
+		ignores: i.ignores,
+	}
+	node, err := t.newNode(path, filepath.Base(path), true, ignorefiles, false)
+	if err != nil {
+		return err
+	}
+	i.unreadable = append(i.unreadable, t.unreadable(node, path)...)
+	return t.collectNode(c, node, path)
+}
+
+// WriteTree writes the entries of the tree, as Walk would do.
+func (i *Ifile) WriteTree(t *Tree) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.node == nil {
+		return nil
+	}
+
+	i.bufMu.Lock()
+	defer i.bufMu.Unlock()
+	i.unreadable = append(i.unreadable, t.unreadable(t.node, t.root)...)
+	if i.mode.writesPatterns() {
+		return i.writePatterns(t.root, t.ignorefiles(), t.filteredPaths(), t.markedPaths(), t.mountPointPaths())
+	}
+	c := i.newCollector()
+	err := t.collect(c, t.node, t.root)
+	if err != nil {
+		return err
+	}
+	return c.flush()
+}
@@ -0,0 +1,142 @@
+package ifile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// Make sure the tree produces the same ifile as Walk, after each change is applied with Update.
+func TestTreeUpdate(t *testing.T) {
+	for _, mode := range []Mode{ModeSyncthing, ModeRestic} {
+		t.Run(mode.String(), func(t *testing.T) {
+			root := t.TempDir()
+			mustWriteFile(t, filepath.Join(root, ".gitignore"), "*.log\nbuild/")
+			mustCreateDir(t, filepath.Join(root, "build", "out"))
+			mustCreateDir(t, filepath.Join(root, "src", "pkg"))
+			mustCreateDir(t, filepath.Join(root, "empty"))
+			mustWriteFile(t, filepath.Join(root, "src", "main.go"), "")
+			mustWriteFile(t, filepath.Join(root, "src", "debug.log"), "")
+			mustWriteFile(t, filepath.Join(root, "src", "pkg", "pkg.go"), "")
+
+			tree := NewTree(root, mode, nil)
+			err := tree.Build()
+			require.NoError(t, err)
+			requireSameAsWalk(t, tree)
+
+			changes := []struct {
+				name   string
+				change func()
+				paths  []string
+			}{
+				{
+					name:   "create file",
+					change: func() { mustWriteFile(t, filepath.Join(root, "src", "trace.log"), "") },
+					paths:  []string{filepath.Join(root, "src", "trace.log")},
+				},
+				{
+					name: "create directory with ignore file",
+					change: func() {
+						mustCreateDir(t, filepath.Join(root, "src", "gen", "sub"))
+						mustWriteFile(t, filepath.Join(root, "src", "gen", ".kopyatignore"), "sub/")
+						mustWriteFile(t, filepath.Join(root, "src", "gen", "gen.go"), "")
+					},
+					paths: []string{filepath.Join(root, "src", "gen")},
+				},
+				{
+					name:   "modify ignore file",
+					change: func() { mustWriteFile(t, filepath.Join(root, "src", "gen", ".kopyatignore"), "*.go") },
+					paths:  []string{filepath.Join(root, "src", "gen", ".kopyatignore")},
+				},
+				{
+					name:   "create ignore file",
+					change: func() { mustWriteFile(t, filepath.Join(root, "src", "pkg", ".gitignore"), "pkg.go") },
+					paths:  []string{filepath.Join(root, "src", "pkg", ".gitignore")},
+				},
+				{
+					name: "rename directory",
+					change: func() {
+						err := os.Rename(filepath.Join(root, "src", "pkg"), filepath.Join(root, "pkg"))
+						require.NoError(t, err)
+					},
+					paths: []string{filepath.Join(root, "src", "pkg"), filepath.Join(root, "pkg")},
+				},
+				{
+					name: "remove root ignore file",
+					change: func() {
+						err := os.Remove(filepath.Join(root, ".gitignore"))
+						require.NoError(t, err)
+					},
+					paths: []string{filepath.Join(root, ".gitignore")},
+				},
+				{
+					name: "remove directory",
+					change: func() {
+						err := os.RemoveAll(filepath.Join(root, "build"))
+						require.NoError(t, err)
+					},
+					paths: []string{filepath.Join(root, "build")},
+				},
+				{
+					// A change in a directory that is not known yet, e.g. because
+					// events of its parent have not been received.
+					name: "create nested directories",
+					change: func() {
+						mustCreateDir(t, filepath.Join(root, "a", "b", "c"))
+						mustWriteFile(t, filepath.Join(root, "a", "b", "c", "file"), "")
+					},
+					paths: []string{filepath.Join(root, "a", "b", "c", "file")},
+				},
+				{
+					// Polling reports directories whose entries have changed.
+					name: "sync directory",
+					change: func() {
+						mustWriteFile(t, filepath.Join(root, "empty", "file"), "")
+						err := os.Remove(filepath.Join(root, "src", "main.go"))
+						require.NoError(t, err)
+					},
+					paths: []string{filepath.Join(root, "empty"), filepath.Join(root, "src")},
+				},
+			}
+			for _, c := range changes {
+				c.change()
+				for _, path := range c.paths {
+					err := tree.Update(path)
+					require.NoError(t, err, c.name)
+				}
+				requireSameAsWalk(t, tree)
+			}
+		})
+	}
+}
+
+func requireSameAsWalk(t *testing.T, tree *Tree) {
+	var (
+		tempDir   = t.TempDir()
+		treeIfile = filepath.Join(tempDir, "tree")
+		walkIfile = filepath.Join(tempDir, "walk")
+	)
+
+	i, err := New(treeIfile, tree.mode, false, zap.NewNop())
+	require.NoError(t, err)
+	err = i.WriteTree(tree)
+	require.NoError(t, err)
+	err = i.Close()
+	require.NoError(t, err)
+
+	i, err = New(walkIfile, tree.mode, false, zap.NewNop())
+	require.NoError(t, err)
+	err = i.Walk(tree.root)
+	require.NoError(t, err)
+	err = i.Close()
+	require.NoError(t, err)
+
+	treeContent, err := os.ReadFile(treeIfile)
+	require.NoError(t, err)
+	walkContent, err := os.ReadFile(walkIfile)
+	require.NoError(t, err)
+	require.Equal(t, string(walkContent), string(treeContent))
+}
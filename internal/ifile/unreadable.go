@@ -0,0 +1,104 @@
+package ifile
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Unreadable is a directory whose entries couldn't be read, e.g. because of its
+// permissions. Unless Options.FailOnUnreadable is set, it is walked as if it
+// were empty, so nothing inside it is in the ifile.
+type Unreadable struct {
+	Path string
+	Err  error
+}
+
+// Unreadable returns the directories that couldn't be read by the walks so far.
+func (i *Ifile) Unreadable() []Unreadable {
+	i.bufMu.Lock()
+	defer i.bufMu.Unlock()
+	return append([]Unreadable(nil), i.unreadable...)
+}
+
+// Read a directory, sorted by name. Replaced in tests, so that directories can be
+// made unreadable for any user, including root.
+var readDir = os.ReadDir
+
+// Like filepath.WalkDir, but directories are read with readDir.
+func walkDir(root string, fn fs.WalkDirFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDirEntry(root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkDirEntry(path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if err == filepath.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	dirEntries, err := readDir(path)
+	if err != nil {
+		// Let fn decide whether the walk fails.
+		err = fn(path, d, err)
+		if err != nil {
+			if err == filepath.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, entry := range dirEntries {
+		err := walkDirEntry(filepath.Join(path, entry.Name()), entry, fn)
+		if err == filepath.SkipDir {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the error of reading a directory is skipped (and the directory is
+// recorded as unreadable) instead of failing the walk.
+func (l *ignoreLoader) skipsUnreadable(err error) bool {
+	return errors.Is(err, fs.ErrPermission) && !l.failOnUnreadable
+}
+
+// Read the directory of node sorted by name. An unreadable directory is treated as
+// empty, and its error is kept in node, unless the walk should fail.
+func (t *Tree) readDir(node *treeNode, path string) ([]fs.DirEntry, error) {
+	dirEntries, err := readDir(path)
+	node.unreadable = nil
+	if err != nil && t.ignores.skipsUnreadable(err) {
+		node.unreadable = err
+		return nil, nil
+	}
+	return dirEntries, err
+}
+
+// Return the unreadable directories in the subtree of node (including itself), in
+// preorder. Should be called with mu locked.
+func (t *Tree) unreadable(node *treeNode, path string) (unreadable []Unreadable) {
+	var add func(node *treeNode, path string)
+	add = func(node *treeNode, path string) {
+		if node.unreadable != nil {
+			unreadable = append(unreadable, Unreadable{Path: path, Err: node.unreadable})
+		}
+		for _, child := range node.children {
+			add(child, filepath.Join(path, child.name))
+		}
+	}
+	add(node, path)
+	return
+}
@@ -0,0 +1,71 @@
+package ifile
+
+import (
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var unreadableTree = testTree{
+	files:      map[string]string{"file": "", "secret/file": ""},
+	unreadable: []string{"secret"},
+}
+
+func checkWalkUnreadable(t *testing.T, root string, workers int) {
+	i, lines := walkToIfile(t, root, ModeRestic, &Options{Workers: workers})
+	require.Contains(t, lines, filepath.Join(root, "file"))
+	require.Len(t, i.Unreadable(), 1)
+	require.Equal(t, filepath.Join(root, "secret"), i.Unreadable()[0].Path)
+	require.ErrorIs(t, i.Unreadable()[0].Err, fs.ErrPermission)
+
+	i, err := NewWithOptions(filepath.Join(t.TempDir(), "ifile"), ModeRestic, false, &Options{Workers: workers, FailOnUnreadable: true}, zap.NewNop())
+	require.NoError(t, err)
+	err = i.Walk(root)
+	require.ErrorIs(t, err, fs.ErrPermission)
+	i.Discard()
+}
+
+func TestTreeUpdateUnreadable(t *testing.T) {
+	root := createTree(t, unreadableTree)
+	unreadable := filepath.Join(root, "secret")
+	tree := NewTree(root, ModeRestic, nil)
+	err := tree.Build()
+	require.NoError(t, err)
+	totals, err := tree.Totals()
+	require.NoError(t, err)
+	require.Len(t, totals.Unreadable, 1)
+
+	// Once it is readable, it is not reported anymore.
+	mustMakeReadable(t, unreadable)
+	err = tree.Update(unreadable)
+	require.NoError(t, err)
+	totals, err = tree.Totals()
+	require.NoError(t, err)
+	require.Empty(t, totals.Unreadable)
+	require.Equal(t, 2, totals.FilesIncluded)
+}
+
+// Make sure a directory that becomes readable is walked again, although other
+// changes of permissions are noise.
+func TestWatchUnreadable(t *testing.T) {
+	for _, opts := range []*WatchJobOptions{
+		{},
+		{Incremental: true},
+		{Poll: true, PollInterval: 50 * time.Millisecond},
+	} {
+		j := newTempWatchJob(t, opts, func(scanPath string) {
+			mustWriteFile(t, filepath.Join(scanPath, "secret", "file"), "")
+			mustMakeUnreadable(t, filepath.Join(scanPath, "secret"))
+		})
+		j.start(t)
+		waitFor(t, func() bool { return j.walks() > 0 })
+		require.Equal(t, []string{filepath.Join(j.scanPath, "secret")}, j.Info().Unreadable)
+
+		mustMakeReadable(t, filepath.Join(j.scanPath, "secret"))
+		waitFor(t, func() bool { return len(j.Info().Unreadable) == 0 })
+	}
+}
@@ -1,20 +1,22 @@
 package ifile
 
 import (
+	"errors"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"syscall"
+	"sync"
 
 	pathspec "github.com/karagenc/go-pathspec"
-	"github.com/karagenc/kopyat/internal/utils"
 )
 
 const (
 	gitignore    = ".gitignore"
 	kopyatignore = ".kopyatignore"
+	// Matches of it are included even if they are excluded by an ignore file.
+	kopyatinclude = ".kopyatinclude"
 
 	// We need to be fast while walking, and this is faster than
 	// comparing strings every time we need to check whether we're
@@ -22,20 +24,107 @@ const (
 	runningOnWindows = runtime.GOOS == "windows"
 )
 
+// Names of the ignore files read if Options.IgnoreFiles is empty.
+var defaultIgnoreFiles = []string{gitignore, kopyatignore}
+
+// ignoreLoader reads the ignore files of directories.
+type ignoreLoader struct {
+	// Names of the ignore files, in the order they are read.
+	names       []string
+	gitExcludes bool
+	filters     *Filters
+	markers     []string
+	// Fail on directories that can't be read, instead of skipping them.
+	failOnUnreadable bool
+	// Walk boundaries. Only the tree walks them.
+	followSymlinks bool
+	oneFileSystem  bool
+
+	// Options.GitExcludesFile. If empty, core.excludesFile of each repository is used.
+	excludesFile string
+
+	// Paths of the git excludes files by the root directories of the repositories,
+	// and the files by their paths. Guarded by excludesMu.
+	excludesMu   sync.Mutex
+	repoExcludes map[string]string
+	excludes     map[string]*gitExcludes
+}
+
+func newIgnoreLoader(opts *Options) *ignoreLoader {
+	if opts == nil {
+		opts = &Options{}
+	}
+	l := &ignoreLoader{
+		names:       opts.IgnoreFiles,
+		gitExcludes: opts.GitExcludes,
+		filters:     opts.Filters,
+		markers:     opts.Markers,
+
+		failOnUnreadable: opts.FailOnUnreadable,
+
+		followSymlinks: opts.FollowSymlinks,
+		oneFileSystem:  opts.OneFileSystem,
+
+		excludesFile: opts.GitExcludesFile,
+		repoExcludes: make(map[string]string),
+		excludes:     make(map[string]*gitExcludes),
+	}
+	if opts.SkipSpecialFiles {
+		filters := Filters{}
+		if l.filters != nil {
+			filters = *l.filters
+		}
+		filters.Sockets, filters.Fifos, filters.Devices = true, true, true
+		l.filters = &filters
+	}
+	if len(l.names) == 0 {
+		l.names = defaultIgnoreFiles
+	}
+	return l
+}
+
+// Whether name is the name of an ignore file, .kopyatinclude, or a marker file.
+func (l *ignoreLoader) isIgnorefile(name string) bool {
+	if name == kopyatinclude || l.isMarker(name) {
+		return true
+	}
+	for _, n := range l.names {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
 func (i *Ifile) Walk(root string) error {
+	if i.workers > 1 || i.mode.writesPatterns() || i.ignores.followSymlinks || i.ignores.oneFileSystem {
+		// Walk directories concurrently into a tree, and write it in the walk order.
+		// The tree also knows which ignore files apply, which the patterns are of,
+		// and unlike walkDir, it can follow symlinks.
+		t := NewTree(root, i.mode, &Options{Workers: i.workers})
+		t.ignores = i.ignores
+		err := t.Build()
+		if err != nil {
+			return err
+		}
+		return i.WriteTree(t)
+	}
+
 	ignorefiles := make([]*ignorefile, 0, 100)
-	entries := make(entries, 0, 10000)
-	err := addIgnoreIfExists(&ignorefiles, root)
+	err := i.ignores.addIgnoreIfExists(&ignorefiles, root)
 	if err != nil {
 		return err
 	}
 
-	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+	i.bufMu.Lock()
+	defer i.bufMu.Unlock()
+	c := i.newCollector()
+
+	err = walkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			if e, ok := err.(*fs.PathError); ok {
-				if e, ok := e.Err.(syscall.Errno); ok && e.Is(fs.ErrPermission) {
-					return nil
-				}
+			if i.ignores.skipsUnreadable(err) {
+				i.unreadable = append(i.unreadable, Unreadable{Path: path, Err: err})
+				return nil
 			}
 			return err
 		} else if path == root {
@@ -43,107 +132,183 @@ func (i *Ifile) Walk(root string) error {
 		}
 
 		t := d.Type()
-		if t.IsDir() {
-			err = addIgnoreIfExists(&ignorefiles, path)
+		match := excluded(ignorefiles, path, t.IsDir(), false)
+		if !match && !t.IsDir() && i.ignores.filters != nil {
+			info, err := d.Info()
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			} else if err == nil {
+				match, err = i.ignores.filtered(path, info)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		marked := false
+		if t.IsDir() && len(i.ignores.markers) > 0 && (!match || couldInclude(ignorefiles, path)) {
+			marker, err := i.ignores.marker(path)
 			if err != nil {
 				return err
 			}
+			marked = marker != ""
+			match = match || marked
 		}
-
-		anyMatches := false
-		for j := len(ignorefiles) - 1; j >= 0; j-- {
-			igFile := ignorefiles[j]
-
-			if strings.HasPrefix(path, igFile.dir) {
-				trimmed := path[len(igFile.dir):]
-				if t.IsDir() && !strings.HasSuffix(trimmed, "/") {
-					trimmed += "/"
-				}
-				match := igFile.p.Match(trimmed)
-
-				if i.mode == ModeRestic && match {
-					if t.IsDir() {
-						return filepath.SkipDir
-					}
-					return nil
-				}
-				if i.mode == ModeSyncthing && match {
-					anyMatches = true
-					path = path[len(root):]
-					break
-				}
+		if match && t.IsDir() && !marked && couldInclude(ignorefiles, path) {
+			// Entries inside might be included by a .kopyatinclude. Walk it into a
+			// tree, which knows whether there are any.
+			err = i.walkExcluded(c, root, path, ignorefiles)
+			if err == nil {
+				return filepath.SkipDir
 			}
+			return err
 		}
 
-		if i.mode == ModeSyncthing && !anyMatches {
+		switch {
+		case !i.mode.listsExcluded() && match:
+			if t.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
-		} else if i.mode == ModeSyncthing {
-			if runningOnWindows {
-				path = utils.StripDriveLetter(path)
+		case i.mode.listsExcluded() && !match:
+			if t.IsDir() {
+				return i.ignores.addIgnoreIfExists(&ignorefiles, path)
 			}
+			return nil
+		case i.mode.listsExcluded():
+			// Everything inside an excluded directory is excluded too. (It is not possible
+			// to re-include a file if a parent directory of that file is excluded.)
+			// Write the directory itself, and skip its contents.
+			err = c.add(&entry{
+				path:  i.mode.excludedPath(root, path),
+				isDir: t.IsDir(),
+			})
+			if err == nil && t.IsDir() {
+				return filepath.SkipDir
+			}
+			return err
 		}
 
-		entries = append(entries, &entry{
+		if t.IsDir() {
+			err = i.ignores.addIgnoreIfExists(&ignorefiles, path)
+			if err != nil {
+				return err
+			}
+		}
+		return c.add(&entry{
 			path:  path,
 			isDir: t.IsDir(),
 		})
-		return nil
 	})
 	if err != nil {
 		return err
 	}
+	return c.flush()
+}
 
-	growLen := 0
-	for _, entry := range entries {
-		growLen += entry.Len()
+// Should be called with bufMu locked.
+func (i *Ifile) newCollector() *collector {
+	w := i.writer()
+	return &collector{
+		write: func(e *entry) error {
+			_, err := w.WriteString(e.format(i.mode))
+			return err
+		},
 	}
+}
 
-	i.bufMu.Lock()
-	defer i.bufMu.Unlock()
-	i.buf.Grow(growLen)
-
-outer:
-	for _, entry := range entries {
-		// If the entry is a directory, check if it contains a children.
-		// If it's empty (doesn't have a children), add it to the list.
-		if entry.isDir {
-			for _, _entry := range entries {
-				if strings.HasPrefix(_entry.path, entry.path) && strings.ContainsRune(strings.TrimPrefix(_entry.path, entry.path), os.PathSeparator) {
-					continue outer
-				}
+func (c *collector) add(e *entry) error {
+	if c.dir != nil {
+		dir := c.dir
+		c.dir = nil
+		if !isInDir(e.path, dir.path) {
+			err := c.write(dir)
+			if err != nil {
+				return err
 			}
 		}
+	}
+	// Rules of ModeRsync are written even if the directory isn't empty.
+	if e.isDir && !e.include && !e.contents {
+		c.dir = e
+		return nil
+	}
+	return c.write(e)
+}
 
-		_, err = i.buf.WriteString(entry.String())
-		if err != nil {
-			return err
+// Write the last directory if it is empty.
+func (c *collector) flush() error {
+	if c.dir == nil {
+		return nil
+	}
+	dir := c.dir
+	c.dir = nil
+	return c.write(dir)
+}
+
+// excluded reports whether path is excluded by the ignore files it is inside of. The
+// closest ignore file with a matching pattern decides, and .kopyatinclude is checked
+// before the ignore files in the same directory. If no pattern matches, path is
+// excluded if its parent directory is.
+func excluded(ignorefiles []*ignorefile, path string, isDir, parentExcluded bool) bool {
+	for j := len(ignorefiles) - 1; j >= 0; j-- {
+		igFile := ignorefiles[j]
+		if !isInDir(path, igFile.dir) {
+			continue
+		}
+		trimmed := path[len(igFile.dir):]
+		if isDir && !strings.HasSuffix(trimmed, "/") {
+			trimmed += "/"
+		}
+		if igFile.p.Match(trimmed) {
+			return !igFile.include
 		}
 	}
-	return err
+	return parentExcluded
 }
 
-func addIgnoreIfExists(ignorefiles *[]*ignorefile, dir string) error {
-	path := filepath.Join(dir, gitignore)
-	if f, err := os.Stat(path); err == nil && f.Mode().Type().IsRegular() {
-		p, err := pathspec.FromFile(path)
+// isInDir reports whether path is strictly inside dir.
+func isInDir(path, dir string) bool {
+	if len(path) <= len(dir) || !strings.HasPrefix(path, dir) {
+		return false
+	}
+	return os.IsPathSeparator(path[len(dir)]) || os.IsPathSeparator(dir[len(dir)-1])
+}
+
+// Add the ignore files of dir. They are added from the lowest precedence to the highest.
+func (l *ignoreLoader) addIgnoreIfExists(ignorefiles *[]*ignorefile, dir string) error {
+	if l.gitExcludes {
+		err := l.addGitExcludes(ignorefiles, dir)
 		if err != nil {
 			return err
 		}
-		*ignorefiles = append(*ignorefiles, &ignorefile{
-			p:   p,
-			dir: dir,
-		})
 	}
 
-	path = filepath.Join(dir, kopyatignore)
+	for _, name := range l.names {
+		path := filepath.Join(dir, name)
+		if f, err := os.Stat(path); err == nil && f.Mode().Type().IsRegular() {
+			p, err := pathspec.FromFile(path)
+			if err != nil {
+				return err
+			}
+			*ignorefiles = append(*ignorefiles, &ignorefile{
+				p:    p,
+				dir:  dir,
+				path: path,
+			})
+		}
+	}
+
+	path := filepath.Join(dir, kopyatinclude)
 	if f, err := os.Stat(path); err == nil && f.Mode().Type().IsRegular() {
 		p, err := pathspec.FromFile(path)
 		if err != nil {
 			return err
 		}
 		*ignorefiles = append(*ignorefiles, &ignorefile{
-			p:   p,
-			dir: dir,
+			p:       p,
+			dir:     dir,
+			path:    path,
+			include: true,
 		})
 	}
 	return nil
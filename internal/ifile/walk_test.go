@@ -1,6 +1,7 @@
 package ifile
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -146,3 +147,340 @@ func TestResticWalkInCurrentProject(t *testing.T) {
 		require.NotContains(t, line, "test_file")
 	}
 }
+
+// Make sure empty directories are written, and directories that have children are not.
+func TestResticWalkEmptyDirs(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "foo"), 0755)
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(root, "foobar", "sub"), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(root, "foobar", "file"), nil, 0644)
+	require.NoError(t, err)
+
+	testIfile := filepath.Join(t.TempDir(), "ifile")
+	i, err := New(testIfile, ModeRestic, false, zap.NewNop())
+	require.NoError(t, err)
+	err = i.Walk(root)
+	require.NoError(t, err)
+	err = i.Close()
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(testIfile)
+	require.NoError(t, err)
+	lines := strings.Split(string(content), "\n")
+	require.Contains(t, lines, filepath.ToSlash(filepath.Join(root, "foo")))
+	require.Contains(t, lines, filepath.ToSlash(filepath.Join(root, "foobar", "sub")))
+	require.Contains(t, lines, filepath.ToSlash(filepath.Join(root, "foobar", "file")))
+	require.NotContains(t, lines, filepath.ToSlash(filepath.Join(root, "foobar")))
+}
+
+// Make sure walking with multiple workers produces the same ifile as walking one by one.
+func TestWalkWorkers(t *testing.T) {
+	root := t.TempDir()
+	err := os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\n"), 0644)
+	require.NoError(t, err)
+	createSyntheticTree(t, root, 3, 4, 4)
+	// Nested ignore files must only apply to their own directory.
+	err = os.WriteFile(filepath.Join(root, "dir_1", ".kopyatignore"), []byte("file_0.txt\ndir_2/\n"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(root, "dir_2", "dir_3", ".gitignore"), []byte("!file_1.log\ndir_0\n"), 0644)
+	require.NoError(t, err)
+
+	for _, mode := range []Mode{ModeRestic, ModeSyncthing, ModeRsync, ModeTar, ModeResticExclude, ModeSyncthingPatterns} {
+		walk := func(workers int) string {
+			testIfile := filepath.Join(t.TempDir(), "ifile")
+			i, err := NewWithOptions(testIfile, mode, false, &Options{Workers: workers}, zap.NewNop())
+			require.NoError(t, err)
+			err = i.Walk(root)
+			require.NoError(t, err)
+			err = i.Close()
+			require.NoError(t, err)
+			content, err := os.ReadFile(testIfile)
+			require.NoError(t, err)
+			return string(content)
+		}
+
+		expected := walk(1)
+		for _, workers := range []int{2, 8} {
+			for n := 0; n < 5; n++ {
+				require.Equal(t, expected, walk(workers), "mode: %s, workers: %d", mode, workers)
+			}
+		}
+	}
+}
+
+// Walk each tree with one worker, and with multiple workers.
+func TestWalkTrees(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		tree  testTree
+		check func(t *testing.T, root string, workers int)
+	}{
+		{name: "markers", tree: markersTree, check: checkWalkMarkers},
+		{name: "include", tree: includeTree, check: checkWalkInclude},
+		{name: "filters", tree: filtersTree, check: checkWalkFilters},
+		{name: "unreadable", tree: unreadableTree, check: checkWalkUnreadable},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			root := createTree(t, c.tree)
+			for _, workers := range []int{1, 4} {
+				t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+					c.check(t, root, workers)
+				})
+			}
+		})
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	sizes := []struct {
+		name          string
+		depth, fanout int
+		files         int
+	}{
+		{name: "1k", depth: 3, fanout: 5, files: 10},
+		{name: "10k", depth: 3, fanout: 10, files: 10},
+		{name: "100k", depth: 3, fanout: 20, files: 10},
+	}
+	for _, size := range sizes {
+		root := b.TempDir()
+		err := os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\n"), 0644)
+		require.NoError(b, err)
+		createSyntheticTree(b, root, size.depth, size.fanout, size.files)
+
+		for _, mode := range []Mode{ModeRestic, ModeSyncthing} {
+			b.Run(size.name+"/"+mode.String(), func(b *testing.B) {
+				testIfile := filepath.Join(b.TempDir(), "ifile")
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					i, err := New(testIfile, mode, false, zap.NewNop())
+					require.NoError(b, err)
+					err = i.Walk(root)
+					require.NoError(b, err)
+					err = i.Close()
+					require.NoError(b, err)
+				}
+			})
+		}
+	}
+}
+
+// Create a tree of directories, each having fanout subdirectories (up to depth)
+// and files. Half of the files are excluded by the .gitignore of BenchmarkWalk.
+func createSyntheticTree(tb testing.TB, dir string, depth, fanout, files int) {
+	for f := 0; f < files; f++ {
+		name := fmt.Sprintf("file_%d.txt", f)
+		if f%2 == 1 {
+			name = fmt.Sprintf("file_%d.log", f)
+		}
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		require.NoError(tb, err)
+	}
+	if depth == 0 {
+		return
+	}
+	for d := 0; d < fanout; d++ {
+		sub := filepath.Join(dir, fmt.Sprintf("dir_%d", d))
+		err := os.Mkdir(sub, 0755)
+		require.NoError(tb, err)
+		createSyntheticTree(tb, sub, depth-1, fanout, files)
+	}
+}
+
+func BenchmarkWalkWorkers(b *testing.B) {
+	root := b.TempDir()
+	err := os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\n"), 0644)
+	require.NoError(b, err)
+	createSyntheticTree(b, root, 3, 20, 10)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			testIfile := filepath.Join(b.TempDir(), "ifile")
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				i, err := NewWithOptions(testIfile, ModeRestic, false, &Options{Workers: workers}, zap.NewNop())
+				require.NoError(b, err)
+				err = i.Walk(root)
+				require.NoError(b, err)
+				err = i.Close()
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// Make sure only the configured ignore files are read.
+func TestWalkIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "build/\n")
+	mustWriteFile(t, filepath.Join(root, "build", "artifact"), "")
+	mustWriteFile(t, filepath.Join(root, "dir", ".dockerignore"), "*.tmp\n")
+	mustWriteFile(t, filepath.Join(root, "dir", "file.tmp"), "")
+
+	for _, workers := range []int{1, 4} {
+		testIfile := filepath.Join(t.TempDir(), "ifile")
+		opts := &Options{Workers: workers, IgnoreFiles: []string{".kopyatignore", ".dockerignore"}}
+		i, err := NewWithOptions(testIfile, ModeRestic, false, opts, zap.NewNop())
+		require.NoError(t, err)
+		err = i.Walk(root)
+		require.NoError(t, err)
+		err = i.Close()
+		require.NoError(t, err)
+		content, err := os.ReadFile(testIfile)
+		require.NoError(t, err)
+
+		lines := strings.Split(string(content), "\n")
+		require.Contains(t, lines, filepath.ToSlash(filepath.Join(root, "build", "artifact")))
+		require.NotContains(t, lines, filepath.ToSlash(filepath.Join(root, "dir", "file.tmp")))
+	}
+}
+
+func TestRsyncAndTarWalk(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "node_modules/\n*.log\n")
+	mustWriteFile(t, filepath.Join(root, "node_modules", "pkg", "index.js"), "")
+	mustWriteFile(t, filepath.Join(root, "src", "main.go"), "")
+	mustWriteFile(t, filepath.Join(root, "src", "debug.log"), "")
+	mustWriteFile(t, filepath.Join(root, "src", "[x]*.log"), "")
+
+	expected := map[Mode][]string{
+		ModeRsync: {"- /node_modules/", "- /src/debug.log", `- /src/\[x]\*.log`},
+		ModeTar:   {"./node_modules", "./src/debug.log", `./src/\[x]\*.log`},
+	}
+	for mode, lines := range expected {
+		for _, workers := range []int{1, 4} {
+			testIfile := filepath.Join(t.TempDir(), "ifile")
+			i, err := NewWithOptions(testIfile, mode, false, &Options{Workers: workers}, zap.NewNop())
+			require.NoError(t, err)
+			err = i.Walk(root)
+			require.NoError(t, err)
+			err = i.Close()
+			require.NoError(t, err)
+			content, err := os.ReadFile(testIfile)
+			require.NoError(t, err)
+
+			got := strings.Split(string(content), "\n")
+			for _, line := range lines {
+				require.Contains(t, got, line, "mode: %s, workers: %d", mode, workers)
+			}
+			for _, line := range got {
+				require.NotContains(t, line, "main.go", "mode: %s, workers: %d", mode, workers)
+				require.NotContains(t, line, "index.js", "mode: %s, workers: %d", mode, workers)
+				if mode == ModeTar {
+					// tar would read comments as patterns.
+					require.False(t, strings.HasPrefix(line, "#"), "workers: %d, line: %s", workers, line)
+				}
+			}
+		}
+	}
+}
+
+// Make sure the entries included by a .kopyatinclude inside an excluded directory get
+// include rules, before the rules that exclude the rest of the directory.
+func TestRsyncWalkInclude(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "build/\n*.log\n")
+	mustWriteFile(t, filepath.Join(root, ".kopyatinclude"), "build/keep\nbuild/sub/\nbuild/deep/keep\n")
+	mustWriteFile(t, filepath.Join(root, "build", "out"), "")
+	mustWriteFile(t, filepath.Join(root, "build", "keep"), "")
+	mustWriteFile(t, filepath.Join(root, "build", "sub", "a"), "")
+	mustWriteFile(t, filepath.Join(root, "build", "sub", ".gitignore"), "*.tmp\n")
+	mustWriteFile(t, filepath.Join(root, "build", "sub", "x.tmp"), "")
+	mustWriteFile(t, filepath.Join(root, "build", "deep", "out"), "")
+	mustWriteFile(t, filepath.Join(root, "build", "deep", "keep"), "")
+
+	for _, workers := range []int{1, 4} {
+		lines := walkToLines(t, root, ModeRsync, &Options{Workers: workers})
+		require.Equal(t, []string{
+			"+ /build/",
+			"+ /build/deep/",
+			"+ /build/deep/keep",
+			"- /build/deep/*",
+			"+ /build/keep",
+			"+ /build/sub/",
+			"- /build/sub/x.tmp",
+			"- /build/*",
+		}, lines[2:len(lines)-2], "workers: %d", workers)
+	}
+}
+
+func TestResticExcludeWalk(t *testing.T) {
+	if runningOnWindows {
+		t.Skip("file names with wildcards are not supported on Windows")
+	}
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "node_modules/\n/build\n")
+	mustWriteFile(t, filepath.Join(root, ".kopyatinclude"), "build/keep\n")
+	mustWriteFile(t, filepath.Join(root, "build", "keep"), "")
+	mustWriteFile(t, filepath.Join(root, "node_modules", "pkg", "index.js"), "")
+	mustWriteFile(t, filepath.Join(root, "$HOME[1]", ".gitignore"), "*.log\n")
+	mustWriteFile(t, filepath.Join(root, "$HOME[1]", "big"), strings.Repeat("0", 100))
+
+	// The patterns are anchored at the directories of the ignore files. Filtered
+	// files are written last, so that no pattern includes them again.
+	escaped := escapeWildcards(root)
+	lines := walkToLines(t, root, ModeResticExclude, &Options{Filters: &Filters{MaxSize: 50}})
+	require.Equal(t, []string{
+		"# .gitignore",
+		escaped + "/node_modules/**",
+		escaped + "/**/node_modules/**",
+		escaped + "/build",
+		"# .kopyatinclude",
+		"!" + escaped + "/build/keep",
+		"# $HOME[1]/.gitignore",
+		escaped + `/$$HOME\[1]/*.log`,
+		escaped + `/$$HOME\[1]/**/*.log`,
+		"# filters",
+		escaped + `/$$HOME\[1]/big`,
+	}, lines[2:len(lines)-2])
+}
+
+// Make sure syncthing mode writes an excluded directory as a single entry, without its contents.
+func TestSyncthingWalkExcludedDir(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, ".gitignore"), "build/\n")
+	mustWriteFile(t, filepath.Join(root, "build", "sub", "artifact"), "")
+	mustWriteFile(t, filepath.Join(root, "src", "main.go"), "")
+
+	for _, workers := range []int{1, 4} {
+		lines := walkToLines(t, root, ModeSyncthing, &Options{Workers: workers})
+		require.Contains(t, lines, "/build", "workers: %d", workers)
+		for _, line := range lines {
+			require.False(t, strings.HasPrefix(line, "/build/"), "workers: %d, line: %s", workers, line)
+			require.NotContains(t, line, "main.go", "workers: %d", workers)
+		}
+	}
+}
+
+// Make sure the patterns of an ignore file don't apply to a sibling of its directory
+// whose name starts with the name of its directory.
+func TestWalkSiblingPrefix(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, "a", ".gitignore"), "b/file\n")
+	mustWriteFile(t, filepath.Join(root, "a", "b", "file"), "")
+	mustWriteFile(t, filepath.Join(root, "ab", "file"), "")
+
+	for _, workers := range []int{1, 4} {
+		lines := walkToLines(t, root, ModeRestic, &Options{Workers: workers})
+		require.NotContains(t, lines, filepath.Join(root, "a", "b", "file"), "workers: %d", workers)
+		require.Contains(t, lines, filepath.Join(root, "ab", "file"), "workers: %d", workers)
+
+		lines = walkToLines(t, root, ModeSyncthing, &Options{Workers: workers})
+		require.Contains(t, lines, "/a/b/file", "workers: %d", workers)
+		require.NotContains(t, lines, "/ab/file", "workers: %d", workers)
+	}
+
+	for _, c := range []struct {
+		path, dir string
+		in        bool
+	}{
+		{"/a/b", "/a", true},
+		{"/a/b/c", "/a", true},
+		{"/ab", "/a", false},
+		{"/a", "/a", false},
+		{"/a", "/", true},
+	} {
+		require.Equal(t, c.in, isInDir(filepath.FromSlash(c.path), filepath.FromSlash(c.dir)), "path: %s, dir: %s", c.path, c.dir)
+	}
+}
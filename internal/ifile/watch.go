@@ -1,12 +1,16 @@
 package ifile
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -21,16 +25,53 @@ type (
 		log       *zap.Logger
 		logS      *zap.SugaredLogger
 		status    atomic.Int32
-		stopped   chan struct{}
+
+		// stopped is closed by Shutdown to stop the current run, and replaced
+		// with a new channel once the run returns, so that the job can be run again.
+		stopped    chan struct{}
+		stopClosed bool
+		done       chan struct{}
+		running    bool
+		runMu      sync.Mutex
 
 		errs   []error
 		errsMu sync.Mutex
 
+		restartPolicy RestartPolicy
+		restarts      atomic.Int32
+
+		// Wait for events to stop arriving for debounce before regenerating the ifile,
+		// but don't wait longer than maxDelay after the first event.
+		debounce        time.Duration
+		maxDelay        time.Duration
+		eventsCoalesced atomic.Int64
+
+		// Whether to poll the filesystem instead of using fsnotify. Set
+		// automatically if registering filesystem watches fails.
+		poll          atomic.Bool
+		pollInterval  time.Duration
+		pollingReason atomic.Value
+		watch         func(root, ifile string, opts *Options, unreadable func() []string) (*fsnotify.Watcher, chan string, error)
+
+		// If incremental is set, the tree is kept between regenerations, and only the
+		// changed paths are walked again. The whole directory is walked every resyncInterval.
+		incremental    bool
+		resyncInterval time.Duration
+		tree           *Tree
+
+		ifileOpts *Options
+		// Whether the last regeneration left the ifile unchanged.
+		unchanged atomic.Bool
+		// Directories that the last regeneration couldn't read.
+		unreadable   []Unreadable
+		unreadableMu sync.Mutex
+
 		scanPath string
 		ifile    string
 		mode     Mode
 
-		walk func() error
+		// Regenerate the ifile. If changed is nil, the whole directory is walked.
+		walk func(changed []string) error
 
 		testEventChanSender atomic.Value
 	}
@@ -38,9 +79,67 @@ type (
 	WatchJobStatus int32
 
 	WatchJobInfo struct {
-		Ifile  string   `json:"ifile"`
-		Errors []string `json:"errors"`
-		Mode   string   `json:"mode"`
+		Ifile    string   `json:"ifile"`
+		Status   string   `json:"status"`
+		Errors   []string `json:"errors"`
+		Mode     string   `json:"mode"`
+		Restarts int      `json:"restarts"`
+		// Number of filesystem events that didn't cause a regeneration of their own,
+		// because they were coalesced with other events.
+		EventsCoalesced int64 `json:"events_coalesced"`
+		// "fsnotify" or "poll"
+		Watcher string `json:"watcher"`
+		// If the job has switched to polling, why it did.
+		PollingFallback string `json:"polling_fallback,omitempty"`
+		// Whether the last regeneration found the ifile identical, and didn't write it.
+		Unchanged bool `json:"unchanged"`
+		// Directories that the last regeneration couldn't read, and skipped.
+		Unreadable []string `json:"unreadable,omitempty"`
+	}
+
+	WatchJobOptions struct {
+		RestartPolicy RestartPolicy
+		// If set, bursts of events separated by less than Debounce
+		// are coalesced into one regeneration of the ifile.
+		Debounce time.Duration
+		// Maximum time to wait after the first event of a burst. 0 means no limit.
+		MaxDelay time.Duration
+		// Poll the filesystem every PollInterval instead of relying on filesystem
+		// notifications, which don't work on network filesystems.
+		Poll         bool
+		PollInterval time.Duration
+		// Keep the ignore files and entries in memory, and walk only the changed
+		// paths again. The whole directory is walked every ResyncInterval to guard
+		// against drift. It is also walked every ResyncInterval if the ifile has age
+		// filters, so that the files that crossed them are picked up.
+		Incremental    bool
+		ResyncInterval time.Duration
+		// Options of the generated ifile, e.g. number of directories to walk concurrently.
+		Ifile Options
+	}
+
+	// changeWatcher reports paths of changes that might affect the ifile.
+	changeWatcher interface {
+		Events() chan string
+		Errors() <-chan error
+		Close() error
+	}
+
+	fsWatcher struct {
+		*fsnotify.Watcher
+		eventChan chan string
+	}
+
+	// RestartPolicy decides whether a failed watch job is restarted, and
+	// how long to wait between retries. The wait starts at Backoff, and
+	// is doubled on each retry up to MaxBackoff.
+	RestartPolicy struct {
+		OnFailure bool
+		// Maximum number of restarts in a row. Restarts are counted again after a run
+		// walks successfully. 0 means unlimited.
+		MaxAttempts int
+		Backoff     time.Duration
+		MaxBackoff  time.Duration
 	}
 )
 
@@ -51,7 +150,15 @@ const (
 	WatchJobStatusStopped
 )
 
-const defaultFailAfter = 20 // 20 seconds
+const (
+	defaultFailAfter  = 20 // 20 seconds
+	defaultBackoff    = time.Second
+	defaultMaxBackoff = time.Minute
+
+	defaultResyncInterval = time.Hour
+	// Walking the whole directory is cheaper than updating too many paths one by one.
+	maxIncrementalChanges = 10000
+)
 
 func (s WatchJobStatus) String() string {
 	switch s {
@@ -69,6 +176,19 @@ func (s WatchJobStatus) String() string {
 }
 
 func NewWatchJob(ifile, scanPath string, mode Mode, runPreHooks, runPostHooks func() error, log *zap.Logger) *WatchJob {
+	return NewWatchJobWithOptions(ifile, scanPath, mode, nil, runPreHooks, runPostHooks, log)
+}
+
+func NewWatchJobWithOptions(
+	ifile, scanPath string,
+	mode Mode,
+	opts *WatchJobOptions,
+	runPreHooks, runPostHooks func() error,
+	log *zap.Logger,
+) *WatchJob {
+	if opts == nil {
+		opts = &WatchJobOptions{}
+	}
 	if runPreHooks == nil {
 		runPreHooks = func() error { return nil }
 	}
@@ -88,18 +208,57 @@ func NewWatchJob(ifile, scanPath string, mode Mode, runPreHooks, runPostHooks fu
 		mode:      mode,
 	}
 	j.status.Store(int32(WatchJobStatusWillRun))
+	j.restartPolicy = opts.RestartPolicy
+	j.debounce = opts.Debounce
+	j.maxDelay = opts.MaxDelay
+	j.poll.Store(opts.Poll)
+	j.pollInterval = opts.PollInterval
+	if j.pollInterval <= 0 {
+		j.pollInterval = defaultPollInterval
+	}
+	j.watch = watch
+	ifileOpts := opts.Ifile
+	j.ifileOpts = &ifileOpts
+	j.incremental = opts.Incremental
+	j.resyncInterval = opts.ResyncInterval
+	if j.resyncInterval <= 0 {
+		j.resyncInterval = defaultResyncInterval
+	}
+	if j.restartPolicy.Backoff <= 0 {
+		j.restartPolicy.Backoff = defaultBackoff
+	}
+	if j.restartPolicy.MaxBackoff <= 0 {
+		j.restartPolicy.MaxBackoff = defaultMaxBackoff
+	}
 
-	j.walk = func() error {
+	j.walk = func(changed []string) error {
 		err := runPreHooks()
 		if err != nil {
 			j.logS.Errorf("One of the prehooks has failed: %v", err)
 		}
-		i, err := New(j.ifile, j.mode, true, j.log)
+		i, err := NewWithOptions(j.ifile, j.mode, true, j.ifileOpts, j.log)
 		if err != nil {
 			return err
 		}
-		defer i.Close()
-		walkErr := i.Walk(j.scanPath)
+		walkErr := j.generate(i, changed)
+		if walkErr != nil {
+			// Keep the last complete ifile.
+			i.Discard()
+		} else {
+			walkErr = i.Close()
+		}
+		if walkErr == nil {
+			j.setUnreadable(i.Unreadable())
+			j.unchanged.Store(i.Unchanged())
+			if i.Unchanged() {
+				j.logS.Debugf("ifile %s is unchanged", j.ifile)
+			}
+		} else {
+			// The ifile is not written, so the post hooks see it as unchanged.
+			j.unchanged.Store(true)
+		}
+		// Post hooks run after the ifile is written, and can tell
+		// whether it has changed with Unchanged.
 		err = runPostHooks()
 		if err != nil {
 			j.logS.Errorf("One of the posthooks has failed: %v", err)
@@ -109,12 +268,62 @@ func NewWatchJob(ifile, scanPath string, mode Mode, runPreHooks, runPostHooks fu
 	return j
 }
 
+func (j *WatchJob) generate(i *Ifile, changed []string) error {
+	if !j.incremental {
+		return i.Walk(j.scanPath)
+	}
+	if changed == nil || j.tree == nil {
+		j.tree = NewTree(j.scanPath, j.mode, j.ifileOpts)
+		err := j.tree.Build()
+		if err != nil {
+			j.tree = nil
+			return err
+		}
+		return i.WriteTree(j.tree)
+	}
+	for _, path := range changed {
+		err := j.tree.Update(path)
+		if err != nil {
+			j.logS.Warnf("updating %s failed: %v. walking the whole directory", path, err)
+			j.tree = nil
+			return j.generate(i, nil)
+		}
+	}
+	return i.WriteTree(j.tree)
+}
+
+// Return the paths of the directories the last regeneration couldn't read.
+func (j *WatchJob) unreadablePaths() (paths []string) {
+	j.unreadableMu.Lock()
+	defer j.unreadableMu.Unlock()
+	for _, u := range j.unreadable {
+		paths = append(paths, u.Path)
+	}
+	return
+}
+
+// Keep the unreadable directories of the last regeneration, and warn if they have changed.
+func (j *WatchJob) setUnreadable(unreadable []Unreadable) {
+	j.unreadableMu.Lock()
+	defer j.unreadableMu.Unlock()
+	if len(unreadable) != len(j.unreadable) {
+		for _, u := range unreadable {
+			j.logS.Warnf("skipped unreadable directory while generating %s: %v", j.ifile, u.Err)
+		}
+	}
+	j.unreadable = unreadable
+}
+
 func (j *WatchJob) ScanPath() string { return j.scanPath }
 
 func (j *WatchJob) Ifile() string { return j.ifile }
 
 func (j *WatchJob) Status() WatchJobStatus { return WatchJobStatus(j.status.Load()) }
 
+// Unchanged reports whether the last regeneration didn't write the ifile, because
+// it found it identical or failed.
+func (j *WatchJob) Unchanged() bool { return j.unchanged.Load() }
+
 var titleCaser = cases.Title(language.AmericanEnglish)
 
 func (j *WatchJob) Info() *WatchJobInfo {
@@ -125,42 +334,169 @@ func (j *WatchJob) Info() *WatchJobInfo {
 	}
 	j.errsMu.Unlock()
 
+	watcher := "fsnotify"
+	if j.poll.Load() {
+		watcher = "poll"
+	}
+	pollingFallback, _ := j.pollingReason.Load().(string)
+
+	unreadable := j.unreadablePaths()
+
 	return &WatchJobInfo{
-		Ifile:  j.ifile,
-		Errors: errs,
-		Mode:   titleCaser.String(j.mode.String()),
+		Ifile:    j.ifile,
+		Status:   j.Status().String(),
+		Errors:   errs,
+		Mode:     titleCaser.String(j.mode.String()),
+		Restarts: int(j.restarts.Load()),
+
+		EventsCoalesced: j.eventsCoalesced.Load(),
+		Watcher:         watcher,
+		PollingFallback: pollingFallback,
+		Unchanged:       j.unchanged.Load(),
+		Unreadable:      unreadable,
+	}
+}
+
+var ErrWatchJobRunning = fmt.Errorf("watch job is already running")
+
+// Run runs the watch job until it is shut down or it fails. A job that
+// has been shut down or has failed can be run again.
+func (j *WatchJob) Run() error {
+	stopped, done, err := j.begin(false)
+	if err != nil {
+		return err
+	}
+	return j.runUntilStopped(stopped, done)
+}
+
+// Start runs the watch job in a new goroutine if it has been shut down or has failed,
+// and calls exited with the error of the run once it returns. Checking the status and
+// starting the run are done atomically, so concurrent calls can't start it twice.
+func (j *WatchJob) Start(exited func(err error)) error {
+	stopped, done, err := j.begin(true)
+	if err != nil {
+		return err
+	}
+	go func() { exited(j.runUntilStopped(stopped, done)) }()
+	return nil
+}
+
+// Mark the job as running. If onlyIfStopped is set, the job must have been shut down or have failed.
+func (j *WatchJob) begin(onlyIfStopped bool) (stopped, done chan struct{}, err error) {
+	j.runMu.Lock()
+	defer j.runMu.Unlock()
+	if j.running {
+		return nil, nil, ErrWatchJobRunning
+	}
+	if status := j.Status(); onlyIfStopped && status != WatchJobStatusStopped && status != WatchJobStatusFailed {
+		return nil, nil, fmt.Errorf("watch job is %s, not stopped or failed", status)
+	}
+	j.running = true
+	j.done = make(chan struct{})
+	return j.stopped, j.done, nil
+}
+
+func (j *WatchJob) runUntilStopped(stopped, done chan struct{}) (err error) {
+	defer func() {
+		j.runMu.Lock()
+		j.running = false
+		if j.stopClosed {
+			j.stopped = make(chan struct{})
+			j.stopClosed = false
+		}
+		close(done)
+		j.runMu.Unlock()
+	}()
+
+	for attempt := 0; ; attempt++ {
+		j.status.Store(int32(WatchJobStatusWillRun))
+		var walked bool
+		walked, err = j.run(stopped)
+		if err == nil {
+			return nil
+		}
+		if walked {
+			// It has run successfully since the last failure, so this failure
+			// is not another attempt to recover from the last one.
+			attempt = 0
+		}
+		p := &j.restartPolicy
+		if !p.OnFailure || (p.MaxAttempts > 0 && attempt >= p.MaxAttempts) {
+			return err
+		}
+
+		backoff := p.backoff(attempt)
+		j.logS.Infof("watch job failed. restarting in %v (restart %d)", backoff, attempt+1)
+		select {
+		case <-time.After(backoff):
+		case <-stopped:
+			j.status.Store(int32(WatchJobStatusStopped))
+			return nil
+		}
+		j.restarts.Add(1)
 	}
 }
 
-func (j *WatchJob) Run() (err error) {
-	err = j.walk()
+func (p *RestartPolicy) backoff(attempt int) time.Duration {
+	backoff := p.Backoff
+	for i := 0; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, p.MaxBackoff)
+}
+
+// Run the job until it is shut down or it fails. walked reports whether a walk has succeeded.
+func (j *WatchJob) run(stopped <-chan struct{}) (walked bool, err error) {
+	err = j.walk(nil)
 	if err != nil {
 		j.logError(err)
 		j.fail()
 		return
 	}
+	walked = true
 
 	var (
 		last      = time.Now()
-		watcher   *fsnotify.Watcher
+		retries   = 0
+		watcher   changeWatcher
 		eventChan chan string
+
+		// Paths changed since the last walk, and whether the whole directory needs to be walked.
+		changed []string
+		full    bool
+		resyncC <-chan time.Time
 	)
+	// Files cross the age filters as time passes, without any event.
+	if j.incremental || j.ifileOpts.Filters.byAge() {
+		resync := time.NewTicker(j.resyncInterval)
+		defer resync.Stop()
+		resyncC = resync.C
+	}
 
 outer:
 	for {
-		watcher, eventChan, err = watch(j.scanPath)
+		if watcher != nil {
+			// Events might have been missed while the watcher was down.
+			full = true
+		}
+		watcher, err = j.newWatcher()
 		if err != nil {
 			j.logError(err)
-			j.sleepBeforeRetry(1)
+			if !j.sleepBeforeRetry(retries, stopped) {
+				j.status.Store(int32(WatchJobStatusStopped))
+				return walked, nil
+			}
+			retries++
 			// Time since first attempt or last successful walk
 			if time.Since(last).Seconds() >= float64(j.failAfter) {
 				j.fail()
-				return err
+				return walked, err
 			}
 			j.status.Store(int32(WatchJobStatusWillRun))
 			continue
 		}
 
+		eventChan = watcher.Events()
 		j.testEventChanSender.Store(func(path string) {
 			select {
 			case eventChan <- path:
@@ -169,46 +505,154 @@ outer:
 		})
 		j.status.Store(int32(WatchJobStatusRunning))
 
+		var (
+			// Number of events received since the last walk.
+			events    = 0
+			debounce  = newStoppedTimer()
+			maxDelay  = newStoppedTimer()
+			debounceC <-chan time.Time
+			maxDelayC <-chan time.Time
+		)
 		for {
+			regenerate := false
 			select {
 			case path := <-eventChan:
 				j.logS.Debugf("event received. path: %s", path)
-				err := j.walk()
-				if err != nil {
-					j.logError(err)
-					j.sleepBeforeRetry(1)
-					// Time since first attempt or last successful walk
-					if time.Since(last).Seconds() >= float64(j.failAfter) {
-						j.fail()
-						return err
+				events++
+				if j.incremental && !full {
+					if len(changed) < maxIncrementalChanges {
+						changed = append(changed, path)
+					} else {
+						full = true
 					}
-					j.status.Store(int32(WatchJobStatusWillRun))
-					watcher.Close()
-					continue outer
 				}
-				last = time.Now()
-			case err, ok := <-watcher.Errors:
+				if j.debounce <= 0 {
+					regenerate = true
+					break
+				}
+				resetTimer(debounce, j.debounce)
+				debounceC = debounce.C
+				if events == 1 && j.maxDelay > 0 {
+					resetTimer(maxDelay, j.maxDelay)
+					maxDelayC = maxDelay.C
+				}
+			case <-debounceC:
+				regenerate = true
+			case <-maxDelayC:
+				regenerate = true
+			case <-resyncC:
+				j.logS.Debugf("walking the whole directory to resync")
+				full = true
+				regenerate = true
+			case err, ok := <-watcher.Errors():
 				if ok {
 					j.logError(err)
-					j.sleepBeforeRetry(1)
+					watcher.Close()
+					if !j.sleepBeforeRetry(retries, stopped) {
+						j.status.Store(int32(WatchJobStatusStopped))
+						return walked, nil
+					}
+					retries++
 					// Time since first attempt or last successful walk
 					if time.Since(last).Seconds() >= float64(j.failAfter) {
 						j.fail()
-						return err
+						return walked, err
 					}
 					j.status.Store(int32(WatchJobStatusWillRun))
-					watcher.Close()
 					continue outer
 				}
-			case <-j.stopped:
+			case <-stopped:
 				watcher.Close()
+				debounce.Stop()
+				maxDelay.Stop()
 				j.status.Store(int32(WatchJobStatusStopped))
-				return nil
+				return walked, nil
+			}
+			if !regenerate {
+				continue
+			}
+
+			debounce.Stop()
+			maxDelay.Stop()
+			debounceC, maxDelayC = nil, nil
+			if events > 1 {
+				j.eventsCoalesced.Add(int64(events - 1))
+				j.logS.Infof("%d events were coalesced into one regeneration", events)
+			}
+			events = 0
+			if full {
+				changed = nil
+			}
+			err := j.walk(changed)
+			changed, full = nil, false
+			if err != nil {
+				j.logError(err)
+				watcher.Close()
+				if !j.sleepBeforeRetry(retries, stopped) {
+					j.status.Store(int32(WatchJobStatusStopped))
+					return walked, nil
+				}
+				retries++
+				// Time since first attempt or last successful walk
+				if time.Since(last).Seconds() >= float64(j.failAfter) {
+					j.fail()
+					return walked, err
+				}
+				j.status.Store(int32(WatchJobStatusWillRun))
+				continue outer
 			}
+			last = time.Now()
+			retries = 0
 		}
 	}
 }
 
+func (j *WatchJob) newWatcher() (changeWatcher, error) {
+	if j.poll.Load() {
+		return newPollWatcher(j.scanPath, j.ifile, j.ifileOpts, j.pollInterval, j.unreadablePaths)
+	}
+	watcher, eventChan, err := j.watch(j.scanPath, j.ifile, j.ifileOpts, j.unreadablePaths)
+	if err != nil {
+		if watcher != nil {
+			watcher.Close()
+		}
+		if !isWatchLimitErr(err) {
+			return nil, err
+		}
+		j.logS.Warnf("registering filesystem watches failed: %v. falling back to polling every %v", err, j.pollInterval)
+		j.pollingReason.Store(err.Error())
+		j.poll.Store(true)
+		return newPollWatcher(j.scanPath, j.ifile, j.ifileOpts, j.pollInterval, j.unreadablePaths)
+	}
+	return &fsWatcher{Watcher: watcher, eventChan: eventChan}, nil
+}
+
+func (w *fsWatcher) Events() chan string  { return w.eventChan }
+func (w *fsWatcher) Errors() <-chan error { return w.Watcher.Errors }
+
+// Whether the error is caused by the limits of the number of watches (e.g.
+// fs.inotify.max_user_watches) or of open files.
+func isWatchLimitErr(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+func newStoppedTimer() *time.Timer {
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return t
+}
+
+// Stop, drain and reset the timer.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
 func (j *WatchJob) logError(err error) {
 	if err != nil {
 		err = fmt.Errorf("watch: %v", err)
@@ -224,24 +668,60 @@ func (j *WatchJob) logError(err error) {
 	}
 }
 
-func (j *WatchJob) sleepBeforeRetry(seconds time.Duration) {
-	time.Sleep(seconds * time.Second)
-	j.logS.Info("retry in %d second(s)", seconds)
+// sleepBeforeRetry waits longer with each retry, as configured by the restart policy.
+// It returns false if the job is stopped while waiting.
+func (j *WatchJob) sleepBeforeRetry(retries int, stopped <-chan struct{}) bool {
+	backoff := j.restartPolicy.backoff(retries)
+	j.logS.Infof("retry in %v", backoff)
+	select {
+	case <-time.After(backoff):
+		return true
+	case <-stopped:
+		return false
+	}
 }
 
 func (j *WatchJob) fail() { j.status.Store(int32(WatchJobStatusFailed)) }
 
+// Shutdown stops the job if it is running. It doesn't wait
+// for the job to stop; use Wait for that.
 func (j *WatchJob) Shutdown() error {
-	close(j.stopped)
+	j.runMu.Lock()
+	defer j.runMu.Unlock()
+	if !j.running {
+		if j.Status() != WatchJobStatusFailed {
+			j.status.Store(int32(WatchJobStatusStopped))
+		}
+		return nil
+	}
+	if !j.stopClosed {
+		close(j.stopped)
+		j.stopClosed = true
+	}
 	return nil
 }
 
-func watch(root string) (watcher *fsnotify.Watcher, eventChan chan string, err error) {
+// Wait waits for the current run to return.
+func (j *WatchJob) Wait() {
+	j.runMu.Lock()
+	done := j.done
+	running := j.running
+	j.runMu.Unlock()
+	if running {
+		<-done
+	}
+}
+
+// Events of the ifile itself are ignored.
+// unreadable returns the directories the last walk couldn't read. As they might
+// have become readable, changes of their permissions are not noise.
+func watch(root, ifile string, opts *Options, unreadable func() []string) (watcher *fsnotify.Watcher, eventChan chan string, err error) {
 	watcher, err = fsnotify.NewWatcher()
 	if err != nil {
 		return
 	}
 
+	filter := newWatchFilter(root, ifile, opts)
 	eventChan = make(chan string, 1)
 	go func() {
 		for {
@@ -249,30 +729,298 @@ func watch(root string) (watcher *fsnotify.Watcher, eventChan chan string, err e
 			if !ok {
 				return
 			}
-			if event.Has(fsnotify.Create) {
-				if st, err := os.Stat(event.Name); err == nil {
-					if st.IsDir() {
-						watcher.Add(event.Name)
-					}
+			// A moved directory whose watch we have already removed
+			// reports IN_MOVE_SELF without a name.
+			if event.Name == "" || filter.isNoise(event.Name) {
+				continue
+			}
+
+			base := filepath.Base(event.Name)
+			isIgnorefile := filter.ignores.isIgnorefile(base)
+			if isIgnorefile {
+				filter.invalidate(filepath.Dir(event.Name))
+			}
+			if filter.invalidateGitExcludes(event.Name) {
+				isIgnorefile = true
+				// The repository might use another git excludes file now.
+				watchGitExcludes(watcher, filter)
+			}
+			if filter.ignores.isMarker(base) && !event.Has(fsnotify.Create) {
+				// Subdirectories are not watched while the directory is excluded by a marker file.
+				addWatches(watcher, filter, filepath.Dir(event.Name))
+			}
+
+			switch {
+			case event.Has(fsnotify.Create):
+				if st, err := os.Stat(event.Name); err == nil && st.IsDir() {
+					// The directory might have been moved here with its subdirectories.
+					addWatches(watcher, filter, event.Name)
+					// Or it might be a repository with its own git excludes file.
+					watchGitExcludes(watcher, filter)
 				}
-				eventChan <- event.Name
-			} else if event.Has(fsnotify.Write) {
-				base := filepath.Base(event.Name)
-				if base == gitignore || base == kopyatignore {
-					eventChan <- event.Name
+			case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+				// If a directory is renamed, its watch would keep reporting events
+				// with the old path. Its new path is added once it is created.
+				removeWatches(watcher, event.Name)
+				filter.invalidate(event.Name)
+			case event.Has(fsnotify.Write):
+				// Writes can change only the size and the modification time of other files.
+				if !isIgnorefile && !filter.ignores.filters.bySize() && !filter.ignores.filters.byAge() {
+					continue
 				}
+			case event.Has(fsnotify.Chmod) && slices.Contains(unreadable(), event.Name):
+				// Other changes of permissions are noise, but this directory might be readable now.
+			default:
+				continue
 			}
+			eventChan <- event.Name
 		}
 	}()
 
-	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-		if d.IsDir() {
-			err := watcher.Add(path)
+	err = addWatches(watcher, filter, root)
+	if err == nil {
+		err = watchGitExcludes(watcher, filter)
+	}
+	return
+}
+
+// Watch dir and its subdirectories, except the noisy ones.
+func addWatches(watcher *fsnotify.Watcher, filter *watchFilter, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrPermission) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		// Contents of the directory are noise.
+		if filter.isNoise(filepath.Join(path, "_")) {
+			// Watch it for the paths inside it that are not noise, e.g. its marker files.
+			exceptions := filter.exceptions(path)
+			if len(exceptions) == 0 {
+				return filepath.SkipDir
+			}
+			err = watcher.Add(path)
 			if err != nil {
 				return err
 			}
+			for _, e := range exceptions {
+				if st, err := os.Stat(e); err == nil && st.IsDir() {
+					err = addWatches(watcher, filter, e)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return filepath.SkipDir
 		}
-		return nil
+		err = watcher.Add(path)
+		if errors.Is(err, fs.ErrPermission) {
+			// It is reported as unreadable by the walk.
+			return filepath.SkipDir
+		}
+		return err
 	})
+}
+
+// Watch the directories of the git excludes files that are outside the watched
+// directory. The directories are watched instead of the files, as editors replace files.
+func watchGitExcludes(watcher *fsnotify.Watcher, filter *watchFilter) error {
+	for _, path := range filter.gitExcludesFiles() {
+		if isInDir(path, filter.root) {
+			continue
+		}
+		err := watcher.Add(filepath.Dir(path))
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			// Walks still read it once it is created.
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop watching path and its subdirectories.
+func removeWatches(watcher *fsnotify.Watcher, path string) {
+	for _, watched := range watcher.WatchList() {
+		if watched == path || isInDir(watched, path) {
+			// Might be already removed.
+			watcher.Remove(watched)
+		}
+	}
+}
+
+// watchFilter tells which events are noise. Events are noise if they happen
+// inside an excluded directory (unless a .kopyatinclude might include entries
+// inside it), or inside a .git directory, as they can't affect the ifile.
+// Inside a directory excluded by a marker file, only events of its marker
+// files are not noise. If git's excludes are respected, events of the files
+// they are read from are not noise either. Writes of the ifile itself are noise too.
+type watchFilter struct {
+	root    string
+	ifile   string
+	ignores *ignoreLoader
+	// Ignore files of directories. Key is the directory.
+	cache map[string][]*ignorefile
+	// Whether directories are excluded by marker files. Key is the directory.
+	marked map[string]bool
+	mu     sync.Mutex
+}
+
+func newWatchFilter(root, ifile string, opts *Options) *watchFilter {
+	return &watchFilter{
+		root:    filepath.Clean(root),
+		ifile:   ifile,
+		ignores: newIgnoreLoader(opts),
+		cache:   make(map[string][]*ignorefile),
+		marked:  make(map[string]bool),
+	}
+}
+
+func (f *watchFilter) isNoise(path string) bool {
+	if f.isIfile(path) {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !isInDir(path, f.root) {
+		// Only the git excludes files are watched outside root.
+		return path != f.root && !slices.Contains(f.ignores.excludesPaths(), path)
+	}
+	parts := strings.Split(path[len(f.root):], string(os.PathSeparator))
+
+	var (
+		dir         = f.root
+		ignorefiles = f.ignorefiles(dir)
+		dirExcluded = false
+	)
+	// The last part is the path itself.
+	for _, part := range parts[:len(parts)-1] {
+		if part == "" {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		if part == ".git" {
+			return !f.ignores.gitExcludes || !slices.Contains(gitExcludesFiles, path[len(dir)+1:])
+		}
+		// Excluded directories are walked if a .kopyatinclude might include entries inside them.
+		dirExcluded = excluded(ignorefiles, dir, true, dirExcluded)
+		if dirExcluded && !couldInclude(ignorefiles, dir) {
+			return true
+		}
+		if f.isMarked(dir) {
+			return filepath.Dir(path) != dir || !f.ignores.isMarker(filepath.Base(path))
+		}
+		ignorefiles = append(ignorefiles[:len(ignorefiles):len(ignorefiles)], f.ignorefiles(dir)...)
+	}
+	return false
+}
+
+// Whether dir is excluded by a marker file. Should be called with f.mu locked.
+func (f *watchFilter) isMarked(dir string) bool {
+	if len(f.ignores.markers) == 0 {
+		return false
+	}
+	marked, ok := f.marked[dir]
+	if !ok {
+		// Errors are reported by walking.
+		marker, _ := f.ignores.marker(dir)
+		marked = marker != ""
+		f.marked[dir] = marked
+	}
+	return marked
+}
+
+// If the contents of dir are noise, return the paths inside it that are not: the
+// marker files of a directory excluded by one, and the files of a git directory that
+// git's excludes are read from. The directory is watched (or polled) only for them.
+func (f *watchFilter) exceptions(dir string) (paths []string) {
+	if !f.isNoise(filepath.Join(dir, "_")) {
+		return nil
+	}
+	names := f.ignores.markers
+	if f.ignores.gitExcludes {
+		switch {
+		case filepath.Base(dir) == ".git":
+			names = append(names[:len(names):len(names)], "commondir", "config", "info")
+		case filepath.Base(dir) == "info" && filepath.Base(filepath.Dir(dir)) == ".git":
+			names = append(names[:len(names):len(names)], "exclude")
+		}
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if !f.isNoise(path) {
+			paths = append(paths, path)
+		}
+	}
 	return
 }
+
+// If path is a file that git's excludes are read from, forget the ignore files
+// it changes, and report whether it is one.
+func (f *watchFilter) invalidateGitExcludes(path string) bool {
+	f.mu.Lock()
+	dir, ok := f.ignores.invalidateGitExcludes(path, f.root)
+	f.mu.Unlock()
+	if ok {
+		f.invalidate(dir)
+		// Look the git excludes file of the repository up again, so that it can be watched.
+		f.mu.Lock()
+		f.ignorefiles(dir)
+		f.mu.Unlock()
+	}
+	return ok
+}
+
+// Return the paths of the git excludes files of the repositories found so far.
+func (f *watchFilter) gitExcludesFiles() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ignores.excludesPaths()
+}
+
+// Whether path is the ifile, or one of its temporary files.
+func (f *watchFilter) isIfile(path string) bool {
+	if f.ifile == "" || filepath.Dir(path) != filepath.Dir(f.ifile) {
+		return false
+	}
+	base := filepath.Base(path)
+	ifileBase := filepath.Base(f.ifile)
+	return base == ifileBase || (strings.HasPrefix(base, "."+ifileBase+".") && strings.HasSuffix(base, ".tmp"))
+}
+
+// Should be called with f.mu locked.
+func (f *watchFilter) ignorefiles(dir string) []*ignorefile {
+	ignorefiles, ok := f.cache[dir]
+	if !ok {
+		err := f.ignores.addIgnoreIfExists(&ignorefiles, dir)
+		if err != nil {
+			// Don't filter anything based on an invalid ignore file.
+			// Walking will report the error.
+			ignorefiles = nil
+		}
+		f.cache[dir] = ignorefiles
+	}
+	return ignorefiles
+}
+
+// Forget the ignore files of dir and its subdirectories.
+func (f *watchFilter) invalidate(dir string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for d := range f.cache {
+		if d == dir || isInDir(d, dir) {
+			delete(f.cache, d)
+		}
+	}
+	for d := range f.marked {
+		if d == dir || isInDir(d, dir) {
+			delete(f.marked, d)
+		}
+	}
+}
@@ -7,9 +7,12 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/karagenc/kopyat/internal/utils"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -38,8 +41,8 @@ func TestWatch(t *testing.T) {
 		mu        sync.Mutex
 	)
 
-	j.walk = func() error {
-		walkErr := walk()
+	j.walk = func(changed []string) error {
+		walkErr := walk(changed)
 		c, err := os.ReadFile(testIfile)
 
 		mu.Lock()
@@ -109,8 +112,8 @@ func TestWatchIgnore(t *testing.T) {
 		mu        sync.Mutex
 	)
 
-	j.walk = func() error {
-		walkErr := walk()
+	j.walk = func(changed []string) error {
+		walkErr := walk(changed)
 		c, err := os.ReadFile(testIfile)
 
 		mu.Lock()
@@ -189,8 +192,8 @@ func TestWatchIgnoreNewlyCreatedDir(t *testing.T) {
 		mu        sync.Mutex
 	)
 
-	j.walk = func() error {
-		walkErr := walk()
+	j.walk = func(changed []string) error {
+		walkErr := walk(changed)
 		c, err := os.ReadFile(testIfile)
 
 		mu.Lock()
@@ -267,7 +270,7 @@ func TestWatchFail(t *testing.T) {
 		mu        sync.Mutex
 	)
 
-	j.walk = func() error {
+	j.walk = func(changed []string) error {
 		mu.Lock()
 		currentWalkCount := walkCount
 		walkCount++
@@ -415,7 +418,7 @@ func TestWatchFailImmediately(t *testing.T) {
 		mu        sync.Mutex
 	)
 
-	j.walk = func() error {
+	j.walk = func(changed []string) error {
 		mu.Lock()
 		walkCount++
 		mu.Unlock()
@@ -430,3 +433,523 @@ func TestWatchFailImmediately(t *testing.T) {
 	require.Equal(t, j.Ifile(), j.ifile)       // Just so that coverage is triggered.
 	require.Equal(t, j.ScanPath(), j.scanPath) // Just so that coverage is triggered.
 }
+
+// Make sure a watch job that was shut down can be run again.
+func TestWatchRestart(t *testing.T) {
+	testIfile := filepath.Join(t.TempDir(), "ifile")
+	j := NewWatchJob(testIfile, scanPath, ModeSyncthing, nil, nil, zap.NewNop())
+
+	for i := 0; i < 3; i++ {
+		errChan := make(chan error, 1)
+		if i == 0 {
+			go func() { errChan <- j.Run() }()
+		} else {
+			// Start only starts stopped and failed jobs, and only once.
+			err := j.Start(func(err error) { errChan <- err })
+			require.NoError(t, err)
+			err = j.Start(func(err error) { t.Error("started twice") })
+			require.ErrorIs(t, err, ErrWatchJobRunning)
+		}
+
+		waitFor(t, func() bool { return j.Status() == WatchJobStatusRunning })
+		require.ErrorIs(t, j.Run(), ErrWatchJobRunning)
+
+		err := j.Shutdown()
+		require.NoError(t, err)
+		j.Wait()
+		require.NoError(t, <-errChan)
+		require.Equal(t, WatchJobStatusStopped, j.Status())
+	}
+
+	j = NewWatchJob(testIfile, scanPath, ModeSyncthing, nil, nil, zap.NewNop())
+	err := j.Start(func(err error) { t.Error("started a job that has never run") })
+	require.Error(t, err)
+}
+
+func TestWatchRestartPolicy(t *testing.T) {
+	testIfile := filepath.Join(t.TempDir(), "ifile")
+	j := NewWatchJobWithOptions(testIfile, scanPath, ModeSyncthing, &WatchJobOptions{
+		RestartPolicy: RestartPolicy{
+			OnFailure:   true,
+			MaxAttempts: 2,
+			Backoff:     10 * time.Millisecond,
+			MaxBackoff:  20 * time.Millisecond,
+		},
+	}, nil, nil, zap.NewNop())
+
+	walkCount := 0
+	j.walk = func(changed []string) error {
+		walkCount++
+		return fmt.Errorf("test walk error")
+	}
+
+	err := j.Run()
+	require.Error(t, err)
+	require.Equal(t, WatchJobStatusFailed, j.Status())
+	require.Equal(t, 3, walkCount) // First run + 2 restarts
+	require.Equal(t, 2, j.Info().Restarts)
+}
+
+// Make sure max attempts are counted from the last successful walk.
+func TestWatchRestartPolicyReset(t *testing.T) {
+	testIfile := filepath.Join(t.TempDir(), "ifile")
+	j := NewWatchJobWithOptions(testIfile, scanPath, ModeSyncthing, &WatchJobOptions{
+		RestartPolicy: RestartPolicy{
+			OnFailure:   true,
+			MaxAttempts: 1,
+			Backoff:     time.Millisecond,
+			MaxBackoff:  time.Millisecond,
+		},
+	}, nil, nil, zap.NewNop())
+	j.failAfter = 0
+
+	walkCount := 0
+	j.walk = func(changed []string) error {
+		walkCount++
+		if walkCount > 3 {
+			return fmt.Errorf("test walk error")
+		}
+		return nil
+	}
+	// Each run fails after its first walk.
+	j.watch = func(root, ifile string, opts *Options, unreadable func() []string) (*fsnotify.Watcher, chan string, error) {
+		return nil, nil, fmt.Errorf("test watch error")
+	}
+
+	err := j.Run()
+	require.Error(t, err)
+	require.Equal(t, WatchJobStatusFailed, j.Status())
+	// 3 runs with a successful walk, each restarted, and the last restart fails.
+	require.Equal(t, 4, walkCount)
+	require.Equal(t, 3, j.Info().Restarts)
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	p := RestartPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	}
+	for attempt, backoff := range expected {
+		require.Equal(t, backoff, p.backoff(attempt))
+	}
+}
+
+// Make sure a burst of events causes only one regeneration.
+func TestWatchDebounce(t *testing.T) {
+	var (
+		tempDir   = t.TempDir()
+		scanPath  = filepath.Join(tempDir, "scan")
+		testIfile = filepath.Join(tempDir, "ifile")
+	)
+	err := os.Mkdir(scanPath, 0755)
+	require.NoError(t, err)
+
+	j := NewWatchJobWithOptions(testIfile, scanPath, ModeSyncthing, &WatchJobOptions{
+		Debounce: 300 * time.Millisecond,
+		MaxDelay: 5 * time.Second,
+	}, nil, nil, zap.NewNop())
+
+	var (
+		walk      = j.walk
+		walkCount = 0
+		mu        sync.Mutex
+	)
+	j.walk = func(changed []string) error {
+		mu.Lock()
+		walkCount++
+		mu.Unlock()
+		return walk(changed)
+	}
+
+	go func() {
+		err := j.Run()
+		require.NoError(t, err)
+	}()
+
+	for {
+		if j.Status() == WatchJobStatusRunning {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	const files = 20
+	for i := 0; i < files; i++ {
+		err := os.WriteFile(filepath.Join(scanPath, fmt.Sprintf("file_%d", i)), nil, 0644)
+		require.NoError(t, err)
+	}
+
+	for {
+		mu.Lock()
+		if walkCount >= 2 {
+			mu.Unlock()
+			break
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	mu.Lock()
+	require.Equal(t, 2, walkCount)
+	mu.Unlock()
+	require.Equal(t, int64(files-1), j.Info().EventsCoalesced)
+
+	err = j.Shutdown()
+	require.NoError(t, err)
+	j.Wait()
+}
+
+type tempWatchJob struct {
+	*WatchJob
+	scanPath string
+
+	walkCount int
+	content   string
+	mu        sync.Mutex
+}
+
+// Run a watch job on a temporary directory. The ifile is kept outside of
+// the scanned directory, so that writing it doesn't cause events.
+func startTempWatchJob(t *testing.T, prepare func(scanPath string)) *tempWatchJob {
+	j := newTempWatchJob(t, nil, prepare)
+	j.start(t)
+	return j
+}
+
+func newTempWatchJob(t *testing.T, opts *WatchJobOptions, prepare func(scanPath string)) *tempWatchJob {
+	var (
+		tempDir   = t.TempDir()
+		scanPath  = filepath.Join(tempDir, "scan")
+		testIfile = filepath.Join(tempDir, "ifile")
+	)
+	err := os.Mkdir(scanPath, 0755)
+	require.NoError(t, err)
+	if prepare != nil {
+		prepare(scanPath)
+	}
+
+	j := &tempWatchJob{
+		WatchJob: NewWatchJobWithOptions(testIfile, scanPath, ModeSyncthing, opts, nil, nil, zap.NewNop()),
+		scanPath: scanPath,
+	}
+	walk := j.walk
+	j.walk = func(changed []string) error {
+		walkErr := walk(changed)
+		c, err := os.ReadFile(testIfile)
+		require.NoError(t, err)
+
+		j.mu.Lock()
+		j.content = string(c)
+		j.walkCount++
+		j.mu.Unlock()
+		return walkErr
+	}
+	return j
+}
+
+func (j *tempWatchJob) start(t *testing.T) {
+	go func() {
+		err := j.Run()
+		require.NoError(t, err)
+	}()
+	t.Cleanup(func() {
+		j.Shutdown()
+		j.Wait()
+	})
+	waitFor(t, func() bool { return j.Status() == WatchJobStatusRunning })
+}
+
+func (j *tempWatchJob) walks() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.walkCount
+}
+
+func (j *tempWatchJob) hasLine(line string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, l := range strings.Split(j.content, "\n") {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// Make sure removing an ignore file causes regeneration.
+func TestWatchRemoveIgnorefile(t *testing.T) {
+	j := startTempWatchJob(t, func(scanPath string) {
+		mustWriteFile(t, filepath.Join(scanPath, ".gitignore"), "ignored")
+		mustWriteFile(t, filepath.Join(scanPath, "ignored"), "")
+	})
+	require.True(t, j.hasLine("/ignored"))
+
+	err := os.Remove(filepath.Join(j.scanPath, ".gitignore"))
+	require.NoError(t, err)
+
+	waitFor(t, func() bool { return j.walks() >= 2 })
+	require.False(t, j.hasLine("/ignored"))
+}
+
+// Make sure renaming an ignore file causes regeneration.
+func TestWatchRenameIgnorefile(t *testing.T) {
+	j := startTempWatchJob(t, func(scanPath string) {
+		mustWriteFile(t, filepath.Join(scanPath, ".kopyatignore"), "ignored")
+		mustWriteFile(t, filepath.Join(scanPath, "ignored"), "")
+	})
+	require.True(t, j.hasLine("/ignored"))
+
+	err := os.Rename(filepath.Join(j.scanPath, ".kopyatignore"), filepath.Join(j.scanPath, "kopyatignore.bak"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return !j.hasLine("/ignored") })
+
+	err = os.Rename(filepath.Join(j.scanPath, "kopyatignore.bak"), filepath.Join(j.scanPath, ".kopyatignore"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return j.hasLine("/ignored") })
+}
+
+// Make sure a renamed directory and its subdirectories are watched with their new path.
+func TestWatchRenameDir(t *testing.T) {
+	j := startTempWatchJob(t, func(scanPath string) {
+		mustCreateDir(t, filepath.Join(scanPath, "dir1", "sub"))
+	})
+
+	err := os.Rename(filepath.Join(j.scanPath, "dir1"), filepath.Join(j.scanPath, "dir2"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return j.walks() >= 2 })
+
+	mustWriteFile(t, filepath.Join(j.scanPath, "dir2", "sub", ".gitignore"), "ignored")
+	mustWriteFile(t, filepath.Join(j.scanPath, "dir2", "sub", "ignored"), "")
+	waitFor(t, func() bool { return j.hasLine("/dir2/sub/ignored") })
+}
+
+// Make sure removed directories are not watched anymore, and
+// excluded and .git directories are not watched at all.
+func TestWatchWatchList(t *testing.T) {
+	scanPath := t.TempDir()
+	mustWriteFile(t, filepath.Join(scanPath, ".gitignore"), "node_modules/")
+	mustCreateDir(t, filepath.Join(scanPath, "node_modules", "pkg"))
+	mustCreateDir(t, filepath.Join(scanPath, ".git", "objects"))
+	mustCreateDir(t, filepath.Join(scanPath, "dir", "sub"))
+
+	watcher, eventChan, err := watch(scanPath, "", nil, func() []string { return nil })
+	require.NoError(t, err)
+	defer watcher.Close()
+	go func() {
+		for range eventChan {
+		}
+	}()
+
+	watched := func(path string) bool {
+		for _, w := range watcher.WatchList() {
+			if w == filepath.Join(scanPath, path) {
+				return true
+			}
+		}
+		return false
+	}
+	require.True(t, watched("dir"))
+	require.True(t, watched("dir/sub"))
+	require.False(t, watched("node_modules"))
+	require.False(t, watched("node_modules/pkg"))
+	require.False(t, watched(".git"))
+	require.False(t, watched(".git/objects"))
+
+	err = os.RemoveAll(filepath.Join(scanPath, "dir"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return !watched("dir") && !watched("dir/sub") })
+}
+
+// Make sure churn inside excluded and .git directories doesn't cause regeneration.
+func TestWatchNoise(t *testing.T) {
+	j := startTempWatchJob(t, func(scanPath string) {
+		mustWriteFile(t, filepath.Join(scanPath, ".gitignore"), "node_modules/")
+		mustCreateDir(t, filepath.Join(scanPath, "node_modules"))
+		mustCreateDir(t, filepath.Join(scanPath, ".git", "objects"))
+	})
+	require.True(t, j.hasLine("/node_modules"))
+
+	for i := 0; i < 10; i++ {
+		mustWriteFile(t, filepath.Join(j.scanPath, "node_modules", fmt.Sprintf("file_%d", i)), "")
+		mustWriteFile(t, filepath.Join(j.scanPath, ".git", "objects", fmt.Sprintf("file_%d", i)), "")
+	}
+	// Events are noise. Make sure the job is still able to receive
+	// events that are not, and it didn't walk for noise before that.
+	mustWriteFile(t, filepath.Join(j.scanPath, "file"), "")
+	waitFor(t, func() bool { return j.walks() >= 2 })
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, 2, j.walks())
+}
+
+func TestWatchPoll(t *testing.T) {
+	j := newTempWatchJob(t, &WatchJobOptions{Poll: true, PollInterval: 50 * time.Millisecond}, nil)
+	j.start(t)
+	require.Equal(t, "poll", j.Info().Watcher)
+	require.Empty(t, j.Info().PollingFallback)
+
+	mustWriteFile(t, filepath.Join(j.scanPath, ".gitignore"), "ignored")
+	mustWriteFile(t, filepath.Join(j.scanPath, "ignored"), "")
+	waitFor(t, func() bool { return j.hasLine("/ignored") })
+
+	// Creation of a directory with an ignore file.
+	mustCreateDir(t, filepath.Join(j.scanPath, "dir"))
+	mustWriteFile(t, filepath.Join(j.scanPath, "dir", ".kopyatignore"), "ignored2")
+	mustWriteFile(t, filepath.Join(j.scanPath, "dir", "ignored2"), "")
+	waitFor(t, func() bool { return j.hasLine("/dir/ignored2") })
+
+	// Modification of an ignore file.
+	mustWriteFile(t, filepath.Join(j.scanPath, ".gitignore"), "not_ignored")
+	waitFor(t, func() bool { return !j.hasLine("/ignored") })
+
+	err := os.RemoveAll(filepath.Join(j.scanPath, "dir"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return !j.hasLine("/dir/ignored2") })
+}
+
+// Make sure the job switches to polling if the limit of filesystem watches is reached.
+func TestWatchPollingFallback(t *testing.T) {
+	j := newTempWatchJob(t, &WatchJobOptions{PollInterval: 50 * time.Millisecond}, nil)
+	j.watch = func(root, ifile string, opts *Options, unreadable func() []string) (*fsnotify.Watcher, chan string, error) {
+		return nil, nil, fmt.Errorf("adding watch: %w", syscall.ENOSPC)
+	}
+	j.start(t)
+	require.Equal(t, "poll", j.Info().Watcher)
+	require.Contains(t, j.Info().PollingFallback, syscall.ENOSPC.Error())
+
+	mustWriteFile(t, filepath.Join(j.scanPath, ".gitignore"), "ignored")
+	mustWriteFile(t, filepath.Join(j.scanPath, "ignored"), "")
+	waitFor(t, func() bool { return j.hasLine("/ignored") })
+}
+
+// Make sure the ifile is regenerated from the changed paths, and the
+// whole directory is walked again on resync.
+func TestWatchIncremental(t *testing.T) {
+	j := newTempWatchJob(t, &WatchJobOptions{Incremental: true, ResyncInterval: 500 * time.Millisecond}, func(scanPath string) {
+		mustWriteFile(t, filepath.Join(scanPath, ".gitignore"), "*.log")
+	})
+	var (
+		fullWalks int
+		mu        sync.Mutex
+	)
+	walk := j.walk
+	j.walk = func(changed []string) error {
+		if changed == nil {
+			mu.Lock()
+			fullWalks++
+			mu.Unlock()
+		}
+		return walk(changed)
+	}
+	j.start(t)
+
+	mustCreateDir(t, filepath.Join(j.scanPath, "dir"))
+	mustWriteFile(t, filepath.Join(j.scanPath, "dir", "debug.log"), "")
+	waitFor(t, func() bool { return j.hasLine("/dir/debug.log") })
+
+	mustWriteFile(t, filepath.Join(j.scanPath, "dir", ".kopyatignore"), "*.txt")
+	mustWriteFile(t, filepath.Join(j.scanPath, "dir", "notes.txt"), "")
+	waitFor(t, func() bool { return j.hasLine("/dir/notes.txt") })
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return fullWalks >= 2
+	})
+	require.True(t, j.hasLine("/dir/debug.log"))
+	require.True(t, j.hasLine("/dir/notes.txt"))
+}
+
+// Make sure writing the ifile inside the watched directory doesn't cause regeneration,
+// and a regeneration that doesn't change the ifile is reported.
+func TestWatchUnchanged(t *testing.T) {
+	var (
+		scanPath  = t.TempDir()
+		testIfile = filepath.Join(scanPath, ".stignore")
+		walks     atomic.Int32
+	)
+	mustWriteFile(t, filepath.Join(scanPath, ".gitignore"), "ignored")
+	mustWriteFile(t, filepath.Join(scanPath, "ignored"), "")
+
+	// Writing a file can cause multiple events.
+	opts := &WatchJobOptions{Debounce: 100 * time.Millisecond}
+	j := NewWatchJobWithOptions(testIfile, scanPath, ModeSyncthing, opts, nil, nil, zap.NewNop())
+	walk := j.walk
+	j.walk = func(changed []string) error {
+		walks.Add(1)
+		return walk(changed)
+	}
+	go func() {
+		err := j.Run()
+		require.NoError(t, err)
+	}()
+	t.Cleanup(func() {
+		j.Shutdown()
+		j.Wait()
+	})
+	waitFor(t, func() bool { return j.Status() == WatchJobStatusRunning })
+	require.False(t, j.Unchanged())
+
+	mustWriteFile(t, filepath.Join(scanPath, "file"), "")
+	waitFor(t, func() bool { return walks.Load() >= 2 })
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(2), walks.Load())
+	require.True(t, j.Unchanged())
+	require.True(t, j.Info().Unchanged)
+
+	mustWriteFile(t, filepath.Join(scanPath, ".gitignore"), "ignored\nfile")
+	waitFor(t, func() bool { return walks.Load() >= 3 })
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(3), walks.Load())
+	require.False(t, j.Unchanged())
+}
+
+// Make sure the post hooks see the ifile as unchanged after a failed regeneration,
+// as it is not written.
+func TestWatchUnchangedAfterFailure(t *testing.T) {
+	var (
+		scanPath  = t.TempDir()
+		testIfile = filepath.Join(t.TempDir(), ".stignore")
+		j         *WatchJob
+		unchanged []bool
+	)
+	runPostHooks := func() error {
+		unchanged = append(unchanged, j.Unchanged())
+		return nil
+	}
+	j = NewWatchJob(testIfile, scanPath, ModeSyncthing, nil, runPostHooks, zap.NewNop())
+	err := j.walk(nil)
+	require.NoError(t, err)
+	err = os.Remove(scanPath)
+	require.NoError(t, err)
+	err = j.walk(nil)
+	require.Error(t, err)
+	require.Equal(t, []bool{false, true}, unchanged)
+}
+
+// Make sure only the configured ignore files are read, and changes to them are reacted to.
+func TestWatchIgnoreFiles(t *testing.T) {
+	for _, opts := range []*WatchJobOptions{
+		{Ifile: Options{IgnoreFiles: []string{".backupignore"}}},
+		{Ifile: Options{IgnoreFiles: []string{".backupignore"}}, Incremental: true},
+		{Ifile: Options{IgnoreFiles: []string{".backupignore"}}, Poll: true, PollInterval: 50 * time.Millisecond},
+	} {
+		j := newTempWatchJob(t, opts, func(scanPath string) {
+			mustWriteFile(t, filepath.Join(scanPath, ".gitignore"), "not_ignored")
+			mustWriteFile(t, filepath.Join(scanPath, "not_ignored"), "")
+			mustWriteFile(t, filepath.Join(scanPath, "dir", "ignored"), "")
+		})
+		j.start(t)
+		waitFor(t, func() bool { return j.walks() > 0 })
+		require.False(t, j.hasLine("/not_ignored"))
+		require.False(t, j.hasLine("/dir/ignored"))
+
+		mustWriteFile(t, filepath.Join(j.scanPath, "dir", ".backupignore"), "ignored")
+		waitFor(t, func() bool { return j.hasLine("/dir/ignored") })
+		require.False(t, j.hasLine("/not_ignored"))
+	}
+}
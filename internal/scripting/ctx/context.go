@@ -30,6 +30,9 @@ type (
 		Post  bool
 		Ifile string
 		Type  string
+		// Only valid for post hook. Whether the generated ifile was identical
+		// to the existing one, and therefore wasn't written.
+		Unchanged bool
 	}
 )
 
@@ -63,13 +66,14 @@ func NewBackupContext(
 	}
 }
 
-func NewIfileGenerationContext(pre bool, ifile string, typ string) Context {
+func NewIfileGenerationContext(pre bool, ifile string, typ string, unchanged bool) Context {
 	return &context{
 		ifileGenerationContext: &IfileGenerationContext{
-			Pre:   pre,
-			Post:  !pre,
-			Ifile: ifile,
-			Type:  typ,
+			Pre:       pre,
+			Post:      !pre,
+			Ifile:     ifile,
+			Type:      typ,
+			Unchanged: unchanged,
 		},
 	}
 }
@@ -0,0 +1,122 @@
+// Package syncthing is a client of the syncthing REST API.
+package syncthing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// FoldersAll selects all folders.
+const FoldersAll = "all"
+
+type (
+	Client struct {
+		url    string
+		apiKey string
+		hc     *http.Client
+	}
+
+	Folder struct {
+		ID    string `json:"id"`
+		Label string `json:"label"`
+		Path  string `json:"path"`
+	}
+)
+
+func NewClient(apiURL, apiKey string) *Client {
+	return &Client{
+		url:    strings.TrimSuffix(apiURL, "/"),
+		apiKey: apiKey,
+		hc:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Folders returns the configured folders. `~` in their paths is expanded.
+func (c *Client) Folders(ctx context.Context) (folders []Folder, err error) {
+	err = c.do(ctx, http.MethodGet, "/rest/config/folders", nil, &folders)
+	if err != nil {
+		return nil, err
+	}
+	for i := range folders {
+		folders[i].Path, err = homedir.Expand(folders[i].Path)
+		if err != nil {
+			return nil, fmt.Errorf("folder %s: %v", folders[i].ID, err)
+		}
+	}
+	return folders, nil
+}
+
+// Ignores makes syncthing load the .stignore of the folder, and returns its lines.
+// It returns an error if syncthing can't parse it.
+func (c *Client) Ignores(ctx context.Context, folder string) ([]string, error) {
+	var resp struct {
+		Ignore []string `json:"ignore"`
+		Error  string   `json:"error"`
+	}
+	err := c.do(ctx, http.MethodGet, "/rest/db/ignores", url.Values{"folder": {folder}}, &resp)
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, fmt.Errorf("ignores of folder %s: %s", folder, resp.Error)
+	}
+	return resp.Ignore, nil
+}
+
+// Rescan requests a rescan of the folder.
+func (c *Client) Rescan(ctx context.Context, folder string) error {
+	return c.do(ctx, http.MethodPost, "/rest/db/scan", url.Values{"folder": {folder}}, nil)
+}
+
+// Send the request, and decode the JSON response into v, if v is not nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, v any) error {
+	u := c.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", c.apiKey)
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("syncthing: %s %s: status: %d, error message: %s", method, path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Select returns the folders with the given IDs, in the order of the IDs, and
+// the IDs that are not found. If ids is `all`, all folders are selected.
+func Select(folders []Folder, ids []string) (selected []Folder, missing []string) {
+	if len(ids) == 1 && ids[0] == FoldersAll {
+		return folders, nil
+	}
+outer:
+	for _, id := range ids {
+		for _, folder := range folders {
+			if folder.ID == id {
+				selected = append(selected, folder)
+				continue outer
+			}
+		}
+		missing = append(missing, id)
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package syncthing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/require"
+)
+
+const testAPIKey = "test-api-key"
+
+// Stand-in for the syncthing REST API.
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+	// Returned by the ignores endpoint.
+	ignoresError string
+}
+
+func newTestServer(t *testing.T, folders []Folder) *testServer {
+	s := &testServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/config/folders", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(folders)
+	})
+	mux.HandleFunc("/rest/db/ignores", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"ignore": []string{"*.log"},
+			"error":  s.ignoresError,
+		})
+	})
+	mux.HandleFunc("/rest/db/scan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != testAPIKey {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+		s.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestClient(t *testing.T) {
+	home, err := homedir.Dir()
+	require.NoError(t, err)
+	s := newTestServer(t, []Folder{
+		{ID: "abcd-1234", Label: "Photos", Path: "/data/photos"},
+		{ID: "efgh-5678", Label: "Notes", Path: "~/notes"},
+	})
+	c := NewClient(s.URL+"/", testAPIKey)
+	ctx := context.Background()
+
+	folders, err := c.Folders(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Folder{
+		{ID: "abcd-1234", Label: "Photos", Path: "/data/photos"},
+		{ID: "efgh-5678", Label: "Notes", Path: filepath.Join(home, "notes")},
+	}, folders)
+
+	ignores, err := c.Ignores(ctx, "abcd-1234")
+	require.NoError(t, err)
+	require.Equal(t, []string{"*.log"}, ignores)
+	err = c.Rescan(ctx, "abcd-1234")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"GET /rest/config/folders",
+		"GET /rest/db/ignores?folder=abcd-1234",
+		"POST /rest/db/scan?folder=abcd-1234",
+	}, s.requests)
+
+	s.ignoresError = "invalid pattern"
+	_, err = c.Ignores(ctx, "abcd-1234")
+	require.ErrorContains(t, err, "invalid pattern")
+
+	_, err = NewClient(s.URL, "wrong-key").Folders(ctx)
+	require.ErrorContains(t, err, "status: 403")
+}
+
+func TestSelect(t *testing.T) {
+	folders := []Folder{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+
+	selected, missing := Select(folders, []string{FoldersAll})
+	require.Equal(t, folders, selected)
+	require.Empty(t, missing)
+
+	selected, missing = Select(folders, []string{"c", "x", "a"})
+	require.Equal(t, []Folder{{ID: "c"}, {ID: "a"}}, selected)
+	require.Equal(t, []string{"x"}, missing)
+}
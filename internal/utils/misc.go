@@ -1,9 +1,12 @@
 package utils
 
 import (
+	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -35,6 +38,76 @@ func DirSize(path string) (int64, error) {
 	return size, err
 }
 
+// FormatBytes formats n in binary units, e.g. 1.5 KiB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseBytes parses a size, e.g. `2GB`, `500 MiB` or `1024`. Units are powers
+// of 1024, whether or not they have an `i` (K, KB and KiB are all 1024 bytes).
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i == -1 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	exp := strings.Index("KMGTPE", unit)
+	if unit == "" {
+		exp = -1
+	} else if exp == -1 || len(unit) != 1 {
+		return 0, fmt.Errorf("invalid unit of size: %s", s)
+	}
+	for ; exp >= 0; exp-- {
+		n *= 1024
+	}
+	if n > math.MaxInt64 {
+		return 0, fmt.Errorf("size is too large: %s", s)
+	}
+	return int64(n), nil
+}
+
+// ParseAge parses a duration like time.ParseDuration does, and also accepts days,
+// weeks and years (365 days), e.g. `30d` or `5y`.
+func ParseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	units := map[byte]time.Duration{
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'y': 365 * 24 * time.Hour,
+	}
+	if len(s) > 1 {
+		if unit, ok := units[s[len(s)-1]]; ok {
+			n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid duration: %s", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	} else if d < 0 {
+		return 0, fmt.Errorf("negative duration: %s", s)
+	}
+	return d, nil
+}
+
 var (
 	r       = rand.New(rand.NewSource(time.Now().UnixNano()))
 	letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
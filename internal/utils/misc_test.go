@@ -2,6 +2,7 @@ package utils
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -33,3 +34,56 @@ func TestStripDriveLetter(t *testing.T) {
 		require.Equal(t, expected[i], newPath)
 	}
 }
+
+func TestFormatBytes(t *testing.T) {
+	require.Equal(t, "0 B", FormatBytes(0))
+	require.Equal(t, "1023 B", FormatBytes(1023))
+	require.Equal(t, "1.0 KiB", FormatBytes(1024))
+	require.Equal(t, "1.5 KiB", FormatBytes(1536))
+	require.Equal(t, "1.0 MiB", FormatBytes(1024*1024))
+	require.Equal(t, "2.5 GiB", FormatBytes(5*1024*1024*1024/2))
+}
+
+func TestParseBytes(t *testing.T) {
+	valid := map[string]int64{
+		"0":       0,
+		"1024":    1024,
+		"1K":      1024,
+		"1 KB":    1024,
+		"1.5KiB":  1536,
+		"500MiB":  500 * 1024 * 1024,
+		"2gb":     2 * 1024 * 1024 * 1024,
+		" 2 GiB ": 2 * 1024 * 1024 * 1024,
+		"1T":      1024 * 1024 * 1024 * 1024,
+		"10B":     10,
+	}
+	for s, expected := range valid {
+		n, err := ParseBytes(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, n, s)
+	}
+	for _, s := range []string{"", "GB", "-1", "1XB", "1KK", "1.2.3M", "10000E"} {
+		_, err := ParseBytes(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	valid := map[string]time.Duration{
+		"1h":   time.Hour,
+		"90m":  90 * time.Minute,
+		"30d":  30 * 24 * time.Hour,
+		"2w":   14 * 24 * time.Hour,
+		"5y":   5 * 365 * 24 * time.Hour,
+		"0.5d": 12 * time.Hour,
+	}
+	for s, expected := range valid {
+		d, err := ParseAge(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, d, s)
+	}
+	for _, s := range []string{"", "y", "-1d", "-1h", "5 years"} {
+		_, err := ParseAge(s)
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,149 @@
+"use strict";
+
+const refreshInterval = 5000;
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === "onclick") {
+      e.addEventListener("click", v);
+    } else {
+      e.setAttribute(k, v);
+    }
+  }
+  for (const child of children) {
+    e.append(child);
+  }
+  return e;
+}
+
+async function request(method, path, body) {
+  // The API rejects state-changing requests without this header.
+  const init = { method: method, headers: { "X-Kopyat-Request": "1" } };
+  if (body !== undefined) {
+    init.headers["Content-Type"] = "application/json";
+    init.body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, init);
+  if (!resp.ok) {
+    throw new Error(`${method} ${path}: ${resp.status} ${await resp.text()}`);
+  }
+  return resp.json();
+}
+
+function setStatus(text, className) {
+  const status = document.getElementById("status");
+  status.textContent = text;
+  status.className = className || "";
+}
+
+// Endpoints that take a list of names return a list of errors.
+async function action(path, names) {
+  try {
+    const errs = await request("POST", path, names);
+    if (errs.length > 0) {
+      setStatus(errs.join("; "), "error");
+    } else {
+      setStatus("Successful", "ok");
+    }
+  } catch (err) {
+    setStatus(err.message, "error");
+  }
+  refresh();
+}
+
+function formatTime(t) {
+  if (!t || t.startsWith("0001-")) {
+    return "";
+  }
+  return new Date(t).toLocaleString();
+}
+
+function result(record) {
+  if (!record) {
+    return el("span", { class: "muted" }, "never");
+  }
+  if (!record.finished || record.finished.startsWith("0001-")) {
+    return el("span", { class: "muted" }, "running");
+  }
+  if (record.skipped) {
+    return el("span", { class: "muted" }, "skipped");
+  }
+  if (record.error) {
+    return el("span", { class: "error" }, record.error);
+  }
+  return el("span", { class: "ok" }, "successful");
+}
+
+function renderWatchJobs(infos) {
+  const tbody = document.querySelector("#watch-jobs tbody");
+  tbody.replaceChildren();
+  for (const info of infos) {
+    const errors = el("td", {});
+    for (const err of info.errors) {
+      errors.append(el("div", { class: "error" }, err));
+    }
+    const actions = el("td", { class: "actions" });
+    if (info.status === "stopped" || info.status === "failed") {
+      actions.append(el("button", { onclick: () => action("/watch-job/start", [info.ifile]) }, "Start"));
+    } else {
+      actions.append(el("button", { onclick: () => action("/watch-job/stop", [info.ifile]) }, "Stop"));
+    }
+    actions.append(el("button", { onclick: () => action("/watch-job/restart", [info.ifile]) }, "Restart"));
+    tbody.append(el("tr", {},
+      el("td", {}, info.ifile),
+      el("td", {}, info.mode),
+      el("td", { class: info.status === "failed" ? "error" : "" }, info.status),
+      errors,
+      actions,
+    ));
+  }
+}
+
+function renderBackups(infos) {
+  const tbody = document.querySelector("#backups tbody");
+  tbody.replaceChildren();
+  for (const info of infos) {
+    const run = el("button", { onclick: () => action("/backup/run", [info.name]) }, "Run now");
+    if (info.running) {
+      run.disabled = true;
+    }
+    tbody.append(el("tr", {},
+      el("td", {}, info.name),
+      el("td", {}, info.last ? formatTime(info.last.started) : ""),
+      el("td", {}, result(info.last)),
+      el("td", { class: "actions" }, run),
+    ));
+  }
+}
+
+function renderBackupHistory(records) {
+  const tbody = document.querySelector("#backup-history tbody");
+  tbody.replaceChildren();
+  for (const record of records) {
+    tbody.append(el("tr", {},
+      el("td", {}, record.name),
+      el("td", {}, formatTime(record.started)),
+      el("td", {}, formatTime(record.finished)),
+      el("td", {}, result(record)),
+    ));
+  }
+}
+
+async function refresh() {
+  try {
+    const [watchJobs, backups, history] = await Promise.all([
+      request("GET", "/watch-job"),
+      request("GET", "/backup"),
+      request("GET", "/backup/history"),
+    ]);
+    renderWatchJobs(watchJobs);
+    renderBackups(backups);
+    renderBackupHistory(history);
+  } catch (err) {
+    setStatus(err.message, "error");
+  }
+}
+
+refresh();
+setInterval(refresh, refreshInterval);